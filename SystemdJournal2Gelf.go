@@ -2,12 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"gopkg.in/Graylog2/go-gelf.v2/gelf"
 	"io"
 	"os"
-	"os/exec"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,108 +18,247 @@ import (
 	https://github.com/Graylog2/graylog2-docs/wiki/GELF
 */
 type SystemdJournalEntry struct {
-	Realtime_timestamp        int64  `json:"__REALTIME_TIMESTAMP,string"`
-	Boot_id                   string `json:"_BOOT_ID"`
-	Priority                  int32  `json:"PRIORITY,string"`
-	Syslog_identifier         string `json:"SYSLOG_IDENTIFIER"`
-	Message                   string `json:"MESSAGE"`
-	Pid                       string `json:"_PID"`
-	Uid                       string `json:"_UID"`
-	Systemd_unit              string `json:"_SYSTEMD_UNIT"`
-	Hostname                  string `json:"_HOSTNAME"`
-	FullMessage               string `json:"-"`
+	Cursor             string
+	Realtime_timestamp int64
+	Boot_id            string
+	Priority           int32
+	Syslog_identifier  string
+	Message            string
+	Pid                string
+	Uid                string
+	Systemd_unit       string
+	Hostname           string
+	FullMessage        string
+	Fields             map[string]string
+	// Set by processing stages: the time the application logged, in microseconds, additional GELF fields,
+	// and whether the priority was taken from the message payload
+	Event_timestamp  int64
+	Extra            map[string]interface{}
+	Priority_decoded bool
 }
 
-// Strip date from message-content
-var startsWithTimestamp = regexp.MustCompile("^20[0-9][0-9][/\\-][01][0-9][/\\-][0123][0-9] [0-2]?[0-9]:[0-5][0-9]:[0-5][0-9][,0-9]{0,3} ")
-
 func (this *SystemdJournalEntry) toGelf() *gelf.Message {
-	var extra = map[string]interface{}{
-		"Boot_id":      this.Boot_id,
-		"Pid":          this.Pid,
-		"Uid":          this.Uid,
-		"Systemd_unit": this.Systemd_unit,
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	var extra = map[string]interface{}{}
+
+	for name, value := range config.Host.labels {
+		extra[name] = value
+	}
+
+	for _, field := range legacyFields {
+		if name, ok := config.Fields.name(field); ok && !config.Fields.denied(field) {
+			extra[name] = this.Fields[field]
+		}
+	}
+
+	for field, value := range this.Fields {
+		if name, ok := config.Fields.name(field); ok && config.Fields.forwarded(field) {
+			extra[name] = value
+		}
+	}
+
+	// entries from many hosts are only distinguishable by their machine id
+	if value, ok := this.Fields["_MACHINE_ID"]; ok && config.Journal.Input == "remote" {
+		if name, ok := config.Fields.name("_MACHINE_ID"); ok && !config.Fields.denied("_MACHINE_ID") {
+			extra[name] = value
+		}
+	}
+
+	for name, value := range this.Extra {
+		extra[name] = value
 	}
 
-	if strings.Contains(this.Message, "\n") {
-		this.FullMessage = this.Message
-		this.Message = strings.Split(this.Message, "\n")[0]
+	timestamp := this.Realtime_timestamp
+	if this.Event_timestamp != 0 {
+		timestamp = this.Event_timestamp
 	}
 
-	return &gelf.Message{
+	message := &gelf.Message{
 		Version:  "1.1",
-		Host:     this.Hostname,
+		Host:     config.Host.host(this),
 		Short:    this.Message,
 		Full:     this.FullMessage,
-		TimeUnix: float64(this.Realtime_timestamp) / 1000 / 1000,
+		TimeUnix: float64(timestamp) / 1000 / 1000,
 		Level:    this.Priority,
 		Facility: this.Syslog_identifier,
 		Extra:    extra,
 	}
+
+	if strings.Contains(message.Short, "\n") {
+		if message.Full == "" {
+			message.Full = message.Short
+		}
+		message.Short = strings.Split(message.Short, "\n")[0]
+	}
+
+	return message
 }
 
-// Custom wrapper to support unprintable chars in message
+// Custom wrapper to support unprintable chars in fields, which journalctl outputs as an array of bytes
 func (this *SystemdJournalEntry) UnmarshalJSON(data []byte) error {
-	// use an alias to prevent recursion
-	type entryAlias SystemdJournalEntry
-	aux := (*entryAlias)(this)
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	fields := make(map[string]string, len(raw))
+	for field, value := range raw {
+		if s, ok, err := decodeJournalValue(value); err != nil {
+			return fmt.Errorf("field %s: %s", field, err)
+		} else if ok {
+			fields[field] = s
+		}
+	}
 
-	if err := json.Unmarshal(data, &aux); err == nil {
-		this.Message = startsWithTimestamp.ReplaceAllString(this.Message, "")
+	return this.setFields(fields)
+}
 
-		return nil
-	} else if ute, ok := err.(*json.UnmarshalTypeError); ok && ute.Field == "MESSAGE" && ute.Value == "array" {
-		// Include brackets, which is why we subtract and add by one
-		len := int64(strings.Index(string(data[ute.Offset:]), `]`)) + 1
+// Values are either a string, an array of bytes, null when too large, or an array of those when a field occurs more than once
+func decodeJournalValue(value json.RawMessage) (string, bool, error) {
+	if string(value) == "null" {
+		return "", false, nil
+	}
 
-		var message []byte
-		if err := json.Unmarshal(data[ute.Offset-1:ute.Offset+len], &message); err != nil {
-			return err
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s, true, nil
+	}
+
+	var list []json.RawMessage
+	if err := json.Unmarshal(value, &list); err != nil {
+		return "", false, err
+	} else if len(list) == 0 {
+		return "", true, nil
+	}
+
+	var b []byte
+	if err := json.Unmarshal(value, &b); err == nil {
+		return string(b), true, nil
+	}
+
+	// only the first of repeated values is kept
+	return decodeJournalValue(list[0])
+}
+
+func (this *SystemdJournalEntry) setFields(fields map[string]string) error {
+	this.Fields = fields
+	this.Cursor = fields["__CURSOR"]
+	this.Boot_id = fields["_BOOT_ID"]
+	this.Syslog_identifier = fields["SYSLOG_IDENTIFIER"]
+	this.Message = fields["MESSAGE"]
+	this.Pid = fields["_PID"]
+	this.Uid = fields["_UID"]
+	this.Systemd_unit = fields["_SYSTEMD_UNIT"]
+	this.Hostname = fields["_HOSTNAME"]
+
+	if v, ok := fields["__REALTIME_TIMESTAMP"]; ok {
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("field __REALTIME_TIMESTAMP: %s", err)
 		}
 
-		// only the failing field is skipped, so we can still use the rest
-		this.Message = string(message)
+		this.Realtime_timestamp = ts
+	}
 
-		return nil
-	} else {
-		return err
+	if v, ok := fields["PRIORITY"]; ok {
+		priority, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("field PRIORITY: %s", err)
+		}
+
+		this.Priority = int32(priority)
 	}
+
+	return nil
 }
 
+// Sends the entry, unless it repeats a recent one, see dedup.go
 func (this *SystemdJournalEntry) send() {
-	message := this.toGelf()
+	configLock.RLock()
+	dedup := config.Dedup
+	configLock.RUnlock()
 
-	for err := writer.WriteMessage(message); err != nil; err = writer.WriteMessage(message) {
-		//	UDP is nonblocking, but the OS stores an error which go will return on the next call.
-		//	This means we've already lost a message, but can keep retrying the current one. Sleep to make this less obtrusive
-		fmt.Fprintln(os.Stderr, "send - processing paused because of: "+err.Error())
-		time.Sleep(SLEEP_AFTER_ERROR)
+	suppressed, previous := dedup.suppress(this, time.Now())
+	if previous != nil {
+		previous.send()
+	}
+
+	if suppressed {
+		acks.done(acks.track(this.Cursor, this.Realtime_timestamp))
+		return
 	}
+
+	this.sendMessage(this.toGelf())
 }
 
+// Sends to the outputs of the matching routes after redacting the message, see output.go and redact.go
+func (this *SystemdJournalEntry) sendMessage(message *gelf.Message) {
+	redact(message)
+
+	configLock.RLock()
+	routes := config.Routes
+	configLock.RUnlock()
+
+	entry := acks.track(this.Cursor, this.Realtime_timestamp)
+	sent := make(map[string]bool)
+	for i := range routes {
+		if !routes[i].matches(this) {
+			continue
+		}
+
+		routes[i].deliver(entry, message, sent)
+
+		if !routes[i].Continue {
+			break
+		}
+	}
+
+	acks.done(entry)
+}
+
+// Holds the last entry until it is clear no continuation lines will follow, see merge.go
 type pendingEntry struct {
 	sync.RWMutex
-	entry *SystemdJournalEntry
+	entry   *SystemdJournalEntry
+	lines   int
+	last    int64
+	updated time.Time
 }
 
 func (this *pendingEntry) Push(next SystemdJournalEntry) {
 	this.Lock()
+	defer this.Unlock()
+
+	this.updated = time.Now()
+
+	if this.entry != nil && this.continuedBy(&next) {
+		this.merge(&next)
+		return
+	}
 
 	if this.entry != nil {
 		this.entry.send()
 	}
 
 	this.entry = &next
-	this.Unlock()
+	this.lines = 1
+	this.last = next.Realtime_timestamp
 }
 
 func (this *pendingEntry) Clear() {
-	if this.entry == nil {
-		return
-	}
+	this.clearIdle(0)
+}
 
+// Sends the pending entry when nothing was pushed for at least idle
+func (this *pendingEntry) clearIdle(idle time.Duration) {
 	this.Lock()
 	entry := this.entry
+	if entry == nil || time.Since(this.updated) < idle {
+		this.Unlock()
+		return
+	}
 	this.entry = nil
 	this.Unlock()
 
@@ -129,61 +268,182 @@ func (this *pendingEntry) Clear() {
 func (this *pendingEntry) ClearEvery(interval time.Duration) {
 	for {
 		time.Sleep(interval)
-		this.Clear()
+		this.clearIdle(interval)
+		summarizeDuplicates(time.Now(), false)
+	}
+}
+
+var config = defaultConfig()
+
+// Guards config and the writers of outputs once the journal is being read, they are replaced on SIGHUP
+var configLock sync.RWMutex
+
+var cursor *cursorState
+
+// Spooled entries must be on disk before the cursor moves past them, so only the cursor from
+// before the spools were synced is saved
+func flushState() {
+	synced := cursor.Get()
+
+	for _, output := range sortedOutputs() {
+		if err := output.spool.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "spool - could not save state of output %s: %s\n", output.name, err)
+		}
+	}
+
+	if err := cursor.Flush(synced); err != nil {
+		fmt.Fprintln(os.Stderr, "cursor - could not save state: "+err.Error())
 	}
 }
 
-var writer gelf.Writer
+func flushStateEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		flushState()
+	}
+}
 
+// WRITE_INTERVAL, SAMESOURCE_TIME_DIFFERENCE, SLEEP_AFTER_ERROR and SHUTDOWN_TIMEOUT are the defaults for timingConfig
 const (
 	WRITE_INTERVAL             = 50 * time.Millisecond
+	STATE_FLUSH_INTERVAL       = 1 * time.Second
+	DIAL_TIMEOUT               = 10 * time.Second
+	WRITE_TIMEOUT              = 10 * time.Second
 	SAMESOURCE_TIME_DIFFERENCE = 100 * 1000
 	SLEEP_AFTER_ERROR          = 15 * time.Second
+	SHUTDOWN_TIMEOUT           = 10 * time.Second
 )
 
-func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("usage: SystemdJournal2Gelf SERVER:12201 [JOURNALCTL PARAMETERS]")
+// Settings come from the -config file, or for backwards compatibility from flags and positional arguments.
+// The path of the config file is returned as well, so it can be reloaded
+func parseArgs() (Config, string) {
+	config := defaultConfig()
+	configFile := flag.String("config", "", "read all settings from this json file, instead of the command line")
+	flag.StringVar(&config.Journal.Format, "journal-format", config.Journal.Format, "journalctl output format to parse, json or export")
+	flag.StringVar(&config.CursorFile, "cursor-file", "", "save the position in the journal to this file and resume from it on startup")
+	flag.StringVar(&config.Spool.Dir, "spool-dir", "", "queue entries in this directory while Graylog is unreachable")
+	flag.Int64Var(&config.Spool.MaxSize, "spool-max-size", config.Spool.MaxSize, "maximum size of the spool in MiB, the oldest entries are dropped first")
+	flag.DurationVar(&config.Spool.MaxAge.Duration, "spool-max-age", 0, "drop spooled entries older than this, 0 keeps them until the size limit is reached")
+	flag.StringVar(&config.Metrics.Listen, "metrics-listen", "", "serve Prometheus metrics on this address, like localhost:9742")
+	flag.StringVar(&config.TLS.CA, "tls-ca", "", "PEM bundle used to verify the server certificate, instead of the system roots")
+	flag.StringVar(&config.TLS.Cert, "tls-cert", "", "PEM client certificate for mutual tls")
+	flag.StringVar(&config.TLS.Key, "tls-key", "", "PEM private key belonging to -tls-cert")
+	flag.StringVar(&config.TLS.ServerName, "tls-server-name", "", "name to verify the server certificate against, defaults to the host in SERVER")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: SystemdJournal2Gelf -config FILE")
+		fmt.Fprintln(flag.CommandLine.Output(), "   or: SystemdJournal2Gelf [OPTIONS] [udp://|tcp://|tls://]SERVER:12201 [JOURNALCTL PARAMETERS]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *configFile != "" {
+		combined := flag.NArg() > 0
+		flag.Visit(func(f *flag.Flag) {
+			combined = combined || f.Name != "config"
+		})
+
+		if combined {
+			fmt.Fprintln(os.Stderr, "-config cannot be combined with other options or arguments")
+			os.Exit(1)
+		}
+
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "config - "+err.Error())
+			os.Exit(1)
+		}
+
+		return c, *configFile
+	}
+
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config.Destination = flag.Arg(0)
+	config.Journal.Args = flag.Args()[1:]
+
+	if err := config.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 
-	if w, err := gelf.NewUDPWriter(os.Args[1]); err != nil {
+	return config, ""
+}
+
+func main() {
+	var configFile string
+	config, configFile = parseArgs()
+
+	if o, err := openOutputs(config.outputConfigs()); err != nil {
 		panic("while connecting to Graylog server: " + err.Error())
 	} else {
-		writer = w
+		outputs = o
 	}
 
-	journalArgs := []string{"--all", "--output=json"}
-	journalArgs = append(journalArgs, os.Args[2:]...)
-	cmd := exec.Command("journalctl", journalArgs...)
+	if config.CursorFile != "" {
+		if c, err := newCursorState(config.CursorFile); err != nil {
+			panic("while reading cursor file: " + err.Error())
+		} else {
+			cursor = c
+		}
+	}
 
-	stderr, _ := cmd.StderrPipe()
-	stdout, _ := cmd.StdoutPipe()
-	go io.Copy(os.Stderr, stderr)
-	d := json.NewDecoder(stdout)
+	for _, output := range outputs {
+		output.startSender(config.Sender)
+		if output.spool != nil {
+			go output.drainSpool()
+		}
+	}
+
+	go flushStateEvery(STATE_FLUSH_INTERVAL)
+	go summarizeRateLimitsEvery(RATE_LIMIT_CHECK_INTERVAL)
+
+	if config.Metrics.Listen != "" {
+		go serveMetrics(config.Metrics.Listen)
+	}
+
+	reader, err := openJournal(config.Journal, cursor)
+	if err != nil {
+		panic("while opening the journal: " + err.Error())
+	}
+
+	stopping := handleSignals(reader, configFile)
 
 	var pending pendingEntry
-	go pending.ClearEvery(WRITE_INTERVAL)
-	cmd.Start()
+	go pending.ClearEvery(config.Timing.WriteInterval.Duration)
 
 	for {
-		var entry SystemdJournalEntry
-		if err := d.Decode(&entry); err != nil {
-			if err == io.EOF {
-				break
-			}
+		// other errors are handled by reopening the input, see supervisedReader
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		metrics.entriesRead.Inc()
+		stripTimestamp(&entry)
+		decodePayload(&entry)
 
-			cmd.Process.Kill()
-			panic("could not parse journal output: " + err.Error())
+		if levelFiltered(&entry) || filtered(&entry) || rateLimited(&entry) {
+			continue
 		}
 
+		// blocks while the outputs are busy, see sender.go
 		pending.Push(entry)
-
-		// Prevent saturation and throttling
-		time.Sleep(1 * time.Millisecond)
 	}
 
-	cmd.Wait()
+	reader.Close()
+
+	// without --follow everything is sent before exiting, when stopped by a signal only until the timeout
+	var timeout time.Duration
+	select {
+	case <-stopping:
+		configLock.RLock()
+		timeout = config.Timing.ShutdownTimeout.Duration
+		configLock.RUnlock()
+	default:
+	}
 
-	pending.Clear()
+	shutdown(&pending, timeout)
 }
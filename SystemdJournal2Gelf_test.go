@@ -32,13 +32,16 @@ func TestUnmarshalEntry(t *testing.T) {
 	AssertEquals(t, "kernel", gelf.Facility)
 
 	AssertEquals(t, 4, len(gelf.Extra))
-	AssertEquals(t, "61c0e40c739f4f009c785cef13b46e17", gelf.Extra["Boot_id"])
-	AssertEquals(t, "99", gelf.Extra["Uid"])
-	AssertEquals(t, "1234", gelf.Extra["Pid"])
+	AssertEquals(t, "61c0e40c739f4f009c785cef13b46e17", gelf.Extra["_Boot_id"])
+	AssertEquals(t, "99", gelf.Extra["_Uid"])
+	AssertEquals(t, "1234", gelf.Extra["_Pid"])
 
 }
 
 func TestJsonMessageOverridesNormalProperties(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Payloads = []payloadConfig{{unitSelector: unitSelector{Identifiers: []string{"kernel"}}, Format: "json"}}
+
 	entry := SystemdJournalEntry{}
 
 	err := json.Unmarshal([]byte(`{
@@ -49,6 +52,7 @@ func TestJsonMessageOverridesNormalProperties(t *testing.T) {
 
 	AssertNotError(t, err)
 
+	decodePayload(&entry)
 	gelf := entry.toGelf()
 
 	AssertEquals(t, "machine.nl", gelf.Host)
@@ -59,6 +63,9 @@ func TestJsonMessageOverridesNormalProperties(t *testing.T) {
 }
 
 func TestJsonMessageIncludeDataInExtra(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Payloads = []payloadConfig{{unitSelector: unitSelector{Identifiers: []string{"kernel"}}, Format: "json"}}
+
 	entry := SystemdJournalEntry{}
 
 	err := json.Unmarshal([]byte(`{
@@ -69,13 +76,14 @@ func TestJsonMessageIncludeDataInExtra(t *testing.T) {
 
 	AssertNotError(t, err)
 
+	decodePayload(&entry)
 	gelf := entry.toGelf()
 
 	AssertEquals(t, "machine.nl", gelf.Host)
 	AssertEquals(t, "actually something else", gelf.Short)
 	AssertEquals(t, "kernel", gelf.Facility)
 	AssertEquals(t, 5, len(gelf.Extra))
-	AssertEquals(t, "things and stuff and more like that", gelf.Extra["stuff"])
+	AssertEquals(t, "things and stuff and more like that", gelf.Extra["_stuff"])
 }
 
 func TestUnmarshalUnprintableEntry(t *testing.T) {
@@ -97,6 +105,27 @@ func TestUnmarshalUnprintableEntry(t *testing.T) {
 
 }
 
+func TestUnmarshalBinaryAndRepeatedFields(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Fields.Allow = []string{"*"}
+
+	entry := SystemdJournalEntry{}
+
+	err := json.Unmarshal([]byte(`{
+        "MESSAGE" : "started",
+        "CODE_FUNC" : [ 109, 97, 105, 110, 7 ],
+        "TAG" : [ "first", "second" ],
+        "LARGE" : null
+	}`), &entry)
+
+	AssertNotError(t, err)
+
+	gelf := entry.toGelf()
+	AssertEquals(t, "main\a", gelf.Extra["_Code_func"])
+	AssertEquals(t, "first", gelf.Extra["_Tag"])
+	AssertEquals(t, nil, gelf.Extra["_Large"])
+}
+
 func TestDateStrippedFromMessage(t *testing.T) {
 	entry := SystemdJournalEntry{}
 
@@ -108,6 +137,7 @@ func TestDateStrippedFromMessage(t *testing.T) {
 
 	AssertNotError(t, err)
 
+	stripTimestamp(&entry)
 	gelf := entry.toGelf()
 
 	AssertEquals(t, "machine.nl", gelf.Host)
@@ -131,6 +161,14 @@ func TestShortLinesDontTriggerPanic(t *testing.T) {
 	AssertEquals(t, "", gelf.Short)
 }
 
+// An entry with the given journal fields, like one read from the journal
+func testEntry(t *testing.T, fields map[string]string) *SystemdJournalEntry {
+	var entry SystemdJournalEntry
+	AssertNotError(t, entry.setFields(fields))
+
+	return &entry
+}
+
 // asserts
 
 func AssertEquals(t *testing.T, expected, actual interface{}) {
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Destination string                  `json:"destination"`
+	TLS         tlsOptions              `json:"tls"`
+	HTTP        httpOptions             `json:"http"`
+	CursorFile  string                  `json:"cursor_file"`
+	Spool       spoolConfig             `json:"spool"`
+	Sender      senderConfig            `json:"sender"`
+	Outputs     map[string]outputConfig `json:"outputs"`
+	Routes      []routeConfig           `json:"routes"`
+	Priority    priorityConfig          `json:"priority"`
+	Severity    []severityConfig        `json:"severity"`
+	Filters     []filterConfig          `json:"filters"`
+	RateLimits  []rateLimitConfig       `json:"rate_limits"`
+	Dedup       dedupConfig             `json:"dedup"`
+	Redaction   redactionConfig         `json:"redaction"`
+	Journal     journalConfig           `json:"journal"`
+	Fields      fieldsConfig            `json:"fields"`
+	Host        hostConfig              `json:"host"`
+	Payloads    []payloadConfig         `json:"payloads"`
+	Timestamps  []timestampConfig       `json:"timestamps"`
+	Multiline   multilineConfig         `json:"multiline"`
+	Metrics     metricsConfig           `json:"metrics"`
+	Timing      timingConfig            `json:"timing"`
+}
+
+type spoolConfig struct {
+	Dir     string   `json:"dir"`
+	MaxSize int64    `json:"max_size"`
+	MaxAge  duration `json:"max_age"`
+}
+
+// Input is "journalctl", "remote", or "sdjournal" when built with -tags sdjournal. Format is
+// the journalctl output format, "json" or "export". Matches are FIELD=value pairs, and "+" to
+// combine the matches before and after it with OR
+type journalConfig struct {
+	Input   string       `json:"input"`
+	Format  string       `json:"format"`
+	Args    []string     `json:"args"`
+	Matches []string     `json:"matches"`
+	Follow  bool         `json:"follow"`
+	Remote  remoteConfig `json:"remote"`
+}
+
+// Serves Prometheus metrics on /metrics when Listen is set
+type metricsConfig struct {
+	Listen string `json:"listen"`
+}
+
+type timingConfig struct {
+	WriteInterval            duration `json:"write_interval"`
+	SameSourceTimeDifference duration `json:"samesource_time_difference"`
+	SleepAfterError          duration `json:"sleep_after_error"`
+	// 0 waits until everything was sent
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+}
+
+// Durations are written as strings in the config file, like "15s"
+type duration struct {
+	time.Duration
+}
+
+func (this *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	d, err := time.ParseDuration(s)
+	this.Duration = d
+
+	return err
+}
+
+func defaultConfig() Config {
+	config := Config{
+		HTTP: defaultHTTPOptions,
+		Spool: spoolConfig{
+			MaxSize: 1024,
+		},
+		Sender: senderConfig{
+			Workers:     SENDER_WORKERS,
+			MaxInFlight: SENDER_MAX_IN_FLIGHT,
+			BatchSize:   SENDER_BATCH_SIZE,
+		},
+		Journal: journalConfig{
+			Input:  "journalctl",
+			Format: "json",
+			Remote: remoteConfig{
+				ReadTimeout: duration{REMOTE_READ_TIMEOUT},
+			},
+		},
+		Fields: fieldsConfig{
+			Style: "legacy",
+			Deny:  []string{"__*"},
+		},
+		Priority: priorityConfig{
+			Default: DEFAULT_LEVEL,
+		},
+		Timestamps: append([]timestampConfig(nil), defaultTimestamps...),
+		Multiline: multilineConfig{
+			Patterns: defaultContinuationPatterns,
+			MaxLines: 500,
+			MaxBytes: 64 * 1024,
+		},
+		Timing: timingConfig{
+			WriteInterval:            duration{WRITE_INTERVAL},
+			SameSourceTimeDifference: duration{SAMESOURCE_TIME_DIFFERENCE * time.Microsecond},
+			SleepAfterError:          duration{SLEEP_AFTER_ERROR},
+			ShutdownTimeout:          duration{SHUTDOWN_TIMEOUT},
+		},
+	}
+
+	config.Multiline.compile()
+	for i := range config.Timestamps {
+		config.Timestamps[i].compile(fmt.Sprintf("timestamps[%d]", i))
+	}
+
+	return config
+}
+
+// Reads a json config file on top of the defaults
+func loadConfig(path string) (Config, error) {
+	config := defaultConfig()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return config, fmt.Errorf("%s: %s", path, err)
+	}
+
+	// json.Unmarshal doesn't tell which key was wrong, so check the structure first
+	if err := checkConfigKeys(raw, reflect.TypeOf(config), ""); err != nil {
+		return config, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return config, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+var durationType = reflect.TypeOf(duration{})
+
+func checkConfigKeys(value interface{}, t reflect.Type, key string) error {
+	if value == nil {
+		return nil
+	}
+
+	if t == durationType {
+		if s, ok := value.(string); !ok {
+			return fmt.Errorf("%s: expected a duration like \"15s\"", key)
+		} else if _, err := time.ParseDuration(s); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+
+		return nil
+	}
+
+	if t == levelType {
+		return checkLevel(value, key)
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok && key == "" {
+			return errors.New("expected an object at the top level")
+		} else if !ok {
+			return fmt.Errorf("%s: expected an object", key)
+		}
+
+		for name, v := range object {
+			field, found := configField(t, name)
+			if !found {
+				return fmt.Errorf("%s: unknown key", joinKey(key, name))
+			}
+
+			if err := checkConfigKeys(v, field.Type, joinKey(key, name)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		return checkConfigKeys(value, t.Elem(), key)
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected a list", key)
+		}
+
+		for i, v := range list {
+			if err := checkConfigKeys(v, t.Elem(), fmt.Sprintf("%s[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object", key)
+		}
+
+		for name, v := range object {
+			if err := checkConfigKeys(v, t.Elem(), joinKey(key, name)); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: expected a string", key)
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected true or false", key)
+		}
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Float64:
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: expected a number", key)
+		}
+	}
+
+	return nil
+}
+
+func joinKey(key, name string) string {
+	if key == "" {
+		return name
+	}
+
+	return key + "." + name
+}
+
+func configField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if strings.Split(field.Tag.Get("json"), ",")[0] == name {
+			return field, true
+		}
+
+		// like encoding/json, the keys of embedded structs are part of the outer object
+		if field.Anonymous {
+			if embedded, ok := configField(field.Type, name); ok {
+				return embedded, true
+			}
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+func (this *Config) validate() error {
+	if err := this.validateOutputs(); err != nil {
+		return err
+	}
+
+	if err := this.Journal.validate(); err != nil {
+		return err
+	}
+
+	if this.Journal.Input == "remote" {
+		if err := this.Journal.Remote.validate(); err != nil {
+			return err
+		}
+
+		if this.CursorFile != "" {
+			return errors.New("cursor_file: not supported by the remote input, systemd-journal-upload keeps track of its own position")
+		}
+	}
+
+	if err := this.Fields.validate(); err != nil {
+		return err
+	}
+
+	if err := this.Host.compile(this.Journal.Input == "remote"); err != nil {
+		return err
+	}
+
+	if err := this.Sender.validate(); err != nil {
+		return err
+	}
+
+	if err := this.Priority.validate(); err != nil {
+		return err
+	}
+
+	for i := range this.Severity {
+		if err := this.Severity[i].compile(fmt.Sprintf("severity[%d]", i)); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range this.Filters {
+		key := fmt.Sprintf("filters[%d]", i)
+		if err := this.Filters[i].validate(key); err != nil {
+			return err
+		}
+
+		if names[this.Filters[i].Name] {
+			return fmt.Errorf("%s.name: %q is already used", key, this.Filters[i].Name)
+		}
+		names[this.Filters[i].Name] = true
+	}
+
+	names = make(map[string]bool)
+	for i := range this.RateLimits {
+		key := fmt.Sprintf("rate_limits[%d]", i)
+		if err := this.RateLimits[i].validate(key); err != nil {
+			return err
+		}
+
+		if names[this.RateLimits[i].Name] {
+			return fmt.Errorf("%s.name: %q is already used", key, this.RateLimits[i].Name)
+		}
+		names[this.RateLimits[i].Name] = true
+	}
+
+	if err := this.Redaction.validate(); err != nil {
+		return err
+	}
+
+	if err := this.Dedup.validate(); err != nil {
+		return err
+	}
+
+	for i := range this.Payloads {
+		if err := this.Payloads[i].validate(fmt.Sprintf("payloads[%d]", i)); err != nil {
+			return err
+		}
+	}
+
+	for i := range this.Timestamps {
+		if err := this.Timestamps[i].compile(fmt.Sprintf("timestamps[%d]", i)); err != nil {
+			return err
+		}
+	}
+
+	if err := this.Multiline.compile(); err != nil {
+		return err
+	}
+
+	if this.Timing.WriteInterval.Duration <= 0 {
+		return errors.New("timing.write_interval: must be positive")
+	}
+
+	if this.Timing.SameSourceTimeDifference.Duration < 0 {
+		return errors.New("timing.samesource_time_difference: must not be negative")
+	}
+
+	if this.Timing.SleepAfterError.Duration <= 0 {
+		return errors.New("timing.sleep_after_error: must be positive")
+	}
+
+	if this.Timing.ShutdownTimeout.Duration < 0 {
+		return errors.New("timing.shutdown_timeout: must not be negative")
+	}
+
+	return nil
+}
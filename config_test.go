@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadConfigString(t *testing.T, data string) (Config, error) {
+	f, err := ioutil.TempFile("", "config")
+	AssertNotError(t, err)
+	defer os.Remove(f.Name())
+
+	f.WriteString(data)
+	f.Close()
+
+	return loadConfig(f.Name())
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := loadConfigString(t, `{
+		"destination": "tcp://graylog:12201",
+		"journal": {"args": ["--follow"]},
+		"spool": {"dir": "/var/lib/spool", "max_age": "1h"},
+		"timing": {"sleep_after_error": "1s"}
+	}`)
+
+	AssertNotError(t, err)
+	AssertEquals(t, "tcp://graylog:12201", config.Destination)
+	AssertEquals(t, "--follow", config.Journal.Args[0])
+	AssertEquals(t, time.Hour, config.Spool.MaxAge.Duration)
+	AssertEquals(t, int64(1024), config.Spool.MaxSize)
+	AssertEquals(t, time.Second, config.Timing.SleepAfterError.Duration)
+	AssertEquals(t, WRITE_INTERVAL, config.Timing.WriteInterval.Duration)
+}
+
+func TestConfigErrorsPointAtKey(t *testing.T) {
+	for data, key := range map[string]string{
+		`{"destination": "localhost:12201", "spool": {"maxsize": 1}}`:         "spool.maxsize: unknown key",
+		`{"destination": "localhost:12201", "timing": {"write_interval": 5}}`: "timing.write_interval: expected a duration",
+		`{"destination": "localhost:12201", "journal": {"args": [1]}}`:        "journal.args[0]: expected a string",
+		`{"destination": "smtp://localhost:25"}`:                              "destination: unsupported scheme",
+		`{"journal": {"args": ["--follow"]}}`:                                 "destination: is required",
+	} {
+		_, err := loadConfigString(t, data)
+
+		AssertError(t, err)
+		if err != nil && !strings.Contains(err.Error(), key) {
+			t.Errorf("expected error about %q, got %q", key, err.Error())
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Keeps track of the __CURSOR of the last entry handed to Graylog, so a restart
+// can continue right after it using journalctl --after-cursor
+type cursorState struct {
+	sync.Mutex
+	path    string
+	current string
+	saved   string
+}
+
+func newCursorState(path string) (*cursorState, error) {
+	this := &cursorState{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return this, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	this.current = strings.TrimSpace(string(data))
+	this.saved = this.current
+
+	return this, nil
+}
+
+// The cursor read from disk at startup, or the last one passed to Update
+func (this *cursorState) Get() string {
+	if this == nil {
+		return ""
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	return this.current
+}
+
+func (this *cursorState) Update(cursor string) {
+	if this == nil || cursor == "" {
+		return
+	}
+
+	this.Lock()
+	this.current = cursor
+	this.Unlock()
+}
+
+// Atomically replace the state file with cursor, a value returned by Get earlier, but only when
+// it changed since the last flush
+func (this *cursorState) Flush(cursor string) error {
+	if this == nil {
+		return nil
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	if cursor == this.saved {
+		return nil
+	}
+
+	if err := writeFileAtomic(this.path, []byte(cursor+"\n")); err != nil {
+		return err
+	}
+
+	this.saved = cursor
+
+	return nil
+}
+
+// Resume after the saved cursor, unless the user explicitly chose a cursor. It replaces the other
+// positions, journalctl refuses to combine them with --after-cursor
+func (this *cursorState) journalArgs(args []string) []string {
+	cursor := this.Get()
+	if cursor == "" {
+		return args
+	}
+
+	for _, arg := range args {
+		switch option, _ := positionOption(arg); option {
+		case "-c", "--cursor", "--after-cursor":
+			return args
+		}
+	}
+
+	return afterCursorArgs(args, cursor)
+}
+
+// Continue after the given cursor, replacing any position the user chose
+func afterCursorArgs(args []string, cursor string) []string {
+	var result []string
+
+	for i := 0; i < len(args); i++ {
+		if option, separate := positionOption(args[i]); option == "" {
+			result = append(result, args[i])
+		} else if separate {
+			// the value is the next argument
+			i++
+		}
+	}
+
+	return append(result, "--after-cursor="+cursor)
+}
+
+// The journalctl options that choose where it starts
+var positionOptions = []string{"-c", "--cursor", "--after-cursor", "--cursor-file", "-S", "--since"}
+
+// Returns the position option arg sets, and whether its value is the next argument
+func positionOption(arg string) (string, bool) {
+	for _, option := range positionOptions {
+		if arg == option {
+			return option, true
+		}
+
+		// short options can be followed by their value directly
+		if strings.HasPrefix(arg, option+"=") || len(option) == 2 && strings.HasPrefix(arg, option) {
+			return option, false
+		}
+	}
+
+	return "", false
+}
+
+// Write to a temporary file first, so a crash never leaves a partially written file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
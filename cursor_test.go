@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCursorRoundtrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cursor")
+	AssertNotError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cursor")
+
+	state, err := newCursorState(path)
+	AssertNotError(t, err)
+	AssertEquals(t, "", state.Get())
+
+	state.Update("s=abc;i=1")
+	AssertNotError(t, state.Flush(state.Get()))
+
+	state, err = newCursorState(path)
+	AssertNotError(t, err)
+	AssertEquals(t, "s=abc;i=1", state.Get())
+
+	// entries acknowledged while the spools were synced are saved the next time
+	synced := state.Get()
+	state.Update("s=abc;i=2")
+	AssertNotError(t, state.Flush(synced))
+
+	state, err = newCursorState(path)
+	AssertNotError(t, err)
+	AssertEquals(t, "s=abc;i=1", state.Get())
+}
+
+func TestCursorAddedToJournalArgs(t *testing.T) {
+	state := &cursorState{current: "s=abc;i=1"}
+
+	args := state.journalArgs([]string{"--follow"})
+	AssertEquals(t, 2, len(args))
+	AssertEquals(t, "--after-cursor=s=abc;i=1", args[1])
+
+	args = state.journalArgs([]string{"--cursor=s=def"})
+	AssertEquals(t, 1, len(args))
+
+	// other positions only apply to the first start
+	args = state.journalArgs([]string{"--since=today", "--follow", "--cursor-file", "/tmp/c"})
+	AssertEquals(t, "--follow --after-cursor=s=abc;i=1", strings.Join(args, " "))
+
+	var disabled *cursorState
+	args = disabled.journalArgs([]string{"--follow"})
+	AssertEquals(t, 1, len(args))
+}
+
+func TestAfterCursorArgsReplacePosition(t *testing.T) {
+	args := afterCursorArgs([]string{"--follow", "-c", "s=abc", "--after-cursor=s=def", "--since=today", "-u", "sshd"}, "s=ghi")
+	AssertEquals(t, "--follow -u sshd --after-cursor=s=ghi", strings.Join(args, " "))
+
+	args = afterCursorArgs([]string{"-S", "today", "--since", "yesterday", "-S2021-01-01", "--cursor-file", "/tmp/c", "--cursor-file=/tmp/d", "-f"}, "s=ghi")
+	AssertEquals(t, "-f --after-cursor=s=ghi", strings.Join(args, " "))
+}
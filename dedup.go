@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Collapses identical messages of the same unit and priority. Only the first one within Window is
+// sent, followed by a summary with the number of repeats once the window passed. Messages are
+// compared after replacing numbers and hexadecimal ids. Enabled when Window is set, for all units and
+// identifiers unless Units or Identifiers are given
+type dedupConfig struct {
+	unitSelector
+	Window duration `json:"window"`
+
+	state *dedupState
+}
+
+// Windows are measured in journal time, so reading a backlog summarizes the same way as following
+// along. Latest is the newest __REALTIME_TIMESTAMP, seen when it was read: while no entries arrive
+// journal time advances with the wall clock from there
+type dedupState struct {
+	sync.Mutex
+	groups map[dedupKey]*dedupGroup
+	latest int64
+	seen   time.Time
+}
+
+type dedupKey struct {
+	hostname, unit, identifier, message string
+	priority                            int32
+}
+
+type dedupGroup struct {
+	last    SystemdJournalEntry
+	first   int64
+	repeats int
+}
+
+// Words with at least one digit, which covers numbers with units, addresses and most ids
+var dedupNormalize = regexp.MustCompile(`\w*[0-9]\w*`)
+
+func (this *dedupConfig) validate() error {
+	if this.Window.Duration < 0 {
+		return fmt.Errorf("dedup.window: must not be negative")
+	}
+
+	if err := this.unitSelector.validate("dedup"); err != nil {
+		return err
+	}
+
+	this.state = &dedupState{groups: make(map[dedupKey]*dedupGroup)}
+
+	return nil
+}
+
+func (this *dedupConfig) applies(entry *SystemdJournalEntry) bool {
+	return this.Window.Duration > 0 && this.matches(entry)
+}
+
+// Reports whether the entry repeats one sent within the window, and should not be sent itself.
+// A repeat after the window closes the group, its summary is returned to be sent first
+func (this *dedupConfig) suppress(entry *SystemdJournalEntry, now time.Time) (bool, *dedupGroup) {
+	if !this.applies(entry) {
+		return false, nil
+	}
+
+	key := dedupKey{
+		hostname:   entry.Hostname,
+		unit:       entry.Systemd_unit,
+		identifier: entry.Syslog_identifier,
+		message:    dedupNormalize.ReplaceAllString(entry.Message, "#"),
+		priority:   entry.Priority,
+	}
+
+	this.state.Lock()
+	defer this.state.Unlock()
+
+	if entry.Realtime_timestamp > this.state.latest {
+		this.state.latest = entry.Realtime_timestamp
+		this.state.seen = now
+	}
+
+	group, ok := this.state.groups[key]
+	if ok && entry.Realtime_timestamp-group.first <= this.Window.Microseconds() {
+		group.last = *entry
+		group.repeats++
+		metrics.duplicatesSuppressed.Inc()
+
+		return true, nil
+	}
+
+	this.state.groups[key] = &dedupGroup{last: *entry, first: entry.Realtime_timestamp}
+
+	if ok && group.repeats > 0 {
+		return false, group
+	}
+
+	return false, nil
+}
+
+// Removes the groups of which the window passed, or all of them, and returns those with repeats
+func (this *dedupConfig) expire(now time.Time, all bool) []*dedupGroup {
+	if this.state == nil {
+		return nil
+	}
+
+	this.state.Lock()
+	defer this.state.Unlock()
+
+	journalNow := this.state.latest + now.Sub(this.state.seen).Microseconds()
+
+	var expired []*dedupGroup
+	for key, group := range this.state.groups {
+		if !all && journalNow-group.first <= this.Window.Microseconds() {
+			continue
+		}
+
+		delete(this.state.groups, key)
+		if group.repeats > 0 {
+			expired = append(expired, group)
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool { return expired[i].first < expired[j].first })
+
+	return expired
+}
+
+// A copy of the last repeat, with the number of repeats and the time of the first and last one
+func (this *dedupGroup) send() {
+	entry := this.last
+	entry.Cursor = ""
+	entry.Message = fmt.Sprintf("Repeated %d times: %s", this.repeats, entry.Message)
+
+	message := entry.toGelf()
+	message.Extra["_repeat_count"] = this.repeats
+	message.Extra["_first_timestamp"] = float64(this.first) / 1000 / 1000
+	message.Extra["_last_timestamp"] = float64(this.last.Realtime_timestamp) / 1000 / 1000
+
+	entry.sendMessage(message)
+}
+
+// Sends summaries of the groups of which the window passed, or of all of them when shutting down
+func summarizeDuplicates(now time.Time, all bool) {
+	configLock.RLock()
+	dedup := config.Dedup
+	configLock.RUnlock()
+
+	for _, group := range dedup.expire(now, all) {
+		group.send()
+	}
+}
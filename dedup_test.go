@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRepeatedMessagesSummarized(t *testing.T) {
+	w := &recordingWriter{}
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": w})()
+
+	config.Dedup.Window.Duration = 10 * time.Second
+	AssertNotError(t, config.Dedup.validate())
+
+	for i, message := range []string{
+		"connection to 10.0.0.1 failed after 1500ms",
+		"connection to 10.0.0.1 failed after 1499ms",
+		"connection to 10.0.0.1 failed after 1501ms",
+		"something else",
+		"connection to 10.0.0.1 failed after 1502ms",
+	} {
+		entry := testEntry(t, map[string]string{
+			"_SYSTEMD_UNIT": "flaky.service", "PRIORITY": "3", "MESSAGE": message,
+			"__REALTIME_TIMESTAMP": strconv.FormatInt((1000+int64(i))*1000*1000, 10),
+		})
+		entry.send()
+	}
+
+	AssertEquals(t, 2, len(w.messages))
+	AssertEquals(t, "connection to 10.0.0.1 failed after 1500ms", w.messages[0].Short)
+	AssertEquals(t, "something else", w.messages[1].Short)
+
+	// the window is measured in journal time, which moves on with the clock while nothing is read
+	summarizeDuplicates(time.Now(), false)
+	AssertEquals(t, 2, len(w.messages))
+
+	summarizeDuplicates(time.Now().Add(10*time.Second), false)
+	AssertEquals(t, 3, len(w.messages))
+	AssertEquals(t, "Repeated 3 times: connection to 10.0.0.1 failed after 1502ms", w.messages[2].Short)
+	AssertEquals(t, 3, w.messages[2].Extra["_repeat_count"])
+	AssertEquals(t, float64(1000), w.messages[2].Extra["_first_timestamp"])
+	AssertEquals(t, float64(1004), w.messages[2].Extra["_last_timestamp"])
+	AssertEquals(t, int32(3), w.messages[2].Level)
+}
+
+func TestRepeatAfterWindowStartsOver(t *testing.T) {
+	w := &recordingWriter{}
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": w})()
+
+	config.Dedup.Window.Duration = 10 * time.Second
+	config.Dedup.Units = []string{"flaky.service"}
+	AssertNotError(t, config.Dedup.validate())
+
+	for _, seconds := range []int64{1000, 1005, 1011} {
+		entry := testEntry(t, map[string]string{
+			"_SYSTEMD_UNIT": "flaky.service", "PRIORITY": "3", "MESSAGE": "disk full",
+			"__REALTIME_TIMESTAMP": strconv.FormatInt(seconds*1000*1000, 10),
+		})
+		entry.send()
+	}
+
+	// the summary of the first window goes before the next first occurrence
+	AssertEquals(t, 3, len(w.messages))
+	AssertEquals(t, "disk full", w.messages[0].Short)
+	AssertEquals(t, "Repeated 1 times: disk full", w.messages[1].Short)
+	AssertEquals(t, "disk full", w.messages[2].Short)
+
+	// nothing was repeated in the second window
+	summarizeDuplicates(time.Now(), true)
+	AssertEquals(t, 3, len(w.messages))
+}
+
+func TestBacklogSummarizedByJournalTime(t *testing.T) {
+	w := &recordingWriter{}
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": w})()
+
+	config.Dedup.Window.Duration = 10 * time.Second
+	AssertNotError(t, config.Dedup.validate())
+
+	// an hour of journal is read within a moment
+	for _, seconds := range []int64{1000, 1001, 1002} {
+		entry := testEntry(t, map[string]string{
+			"_SYSTEMD_UNIT": "flaky.service", "PRIORITY": "3", "MESSAGE": "disk full",
+			"__REALTIME_TIMESTAMP": strconv.FormatInt(seconds*1000*1000, 10),
+		})
+		entry.send()
+	}
+	for _, seconds := range []int64{4600, 4601} {
+		entry := testEntry(t, map[string]string{
+			"_SYSTEMD_UNIT": "flaky.service", "PRIORITY": "3", "MESSAGE": "disk cleaned up",
+			"__REALTIME_TIMESTAMP": strconv.FormatInt(seconds*1000*1000, 10),
+		})
+		entry.send()
+	}
+	AssertEquals(t, 2, len(w.messages))
+
+	summarizeDuplicates(time.Now(), false)
+	AssertEquals(t, 3, len(w.messages))
+	AssertEquals(t, "Repeated 2 times: disk full", w.messages[2].Short)
+
+	// the window of the latest group passes once the clock moved on from the time it was read
+	summarizeDuplicates(time.Now().Add(5*time.Second), false)
+	AssertEquals(t, 3, len(w.messages))
+
+	summarizeDuplicates(time.Now().Add(10*time.Second), false)
+	AssertEquals(t, 4, len(w.messages))
+	AssertEquals(t, "Repeated 1 times: disk cleaned up", w.messages[3].Short)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Decodes the Journal Export Format, as written by journalctl --output=export and sent by
+// systemd-journal-upload. Text fields are written as KEY=value lines, fields with binary or
+// multi-line values as the key on its own line followed by a little endian 64 bit length,
+// the raw value and a newline. Entries are separated by an empty line.
+// https://systemd.io/JOURNAL_EXPORT_FORMATS/
+type exportDecoder struct {
+	r *bufio.Reader
+}
+
+const EXPORT_MAX_FIELD_SIZE = 64 * 1024 * 1024
+
+func newExportDecoder(r io.Reader) *exportDecoder {
+	return &exportDecoder{r: bufio.NewReader(r)}
+}
+
+// Returns the fields of the next entry, or io.EOF when there are no more entries
+func (this *exportDecoder) Decode() (map[string]string, error) {
+	fields := make(map[string]string)
+
+	for {
+		line, err := this.r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			if len(fields) > 0 {
+				return fields, nil
+			}
+
+			return nil, io.EOF
+		} else if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+
+		line = line[:len(line)-1]
+		if len(line) == 0 {
+			if len(fields) > 0 {
+				return fields, nil
+			}
+
+			// tolerate extra separators
+			continue
+		}
+
+		var key, value string
+		if i := bytes.IndexByte(line, '='); i >= 0 {
+			key, value = string(line[:i]), string(line[i+1:])
+		} else {
+			key = string(line)
+			if value, err = this.readBinary(); err != nil {
+				return nil, fmt.Errorf("field %s: %s", key, err)
+			}
+		}
+
+		// only the first of repeated values is kept, like with json
+		if _, ok := fields[key]; !ok {
+			fields[key] = value
+		}
+	}
+}
+
+func (this *exportDecoder) readBinary() (string, error) {
+	var size uint64
+	if err := binary.Read(this.r, binary.LittleEndian, &size); err != nil {
+		return "", err
+	}
+
+	if size > EXPORT_MAX_FIELD_SIZE {
+		return "", fmt.Errorf("value of %d bytes is too large", size)
+	}
+
+	value := make([]byte, size+1)
+	if _, err := io.ReadFull(this.r, value); err != nil {
+		return "", err
+	}
+
+	if value[size] != '\n' {
+		return "", fmt.Errorf("value is not followed by a newline")
+	}
+
+	return string(value[:size]), nil
+}
+
+// Reads an entry in export format, see exportDecoder
+func (this *SystemdJournalEntry) decodeExport(d *exportDecoder) error {
+	fields, err := d.Decode()
+	if err != nil {
+		return err
+	}
+
+	return this.setFields(fields)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func exportBinaryField(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+func TestDecodeExportFormat(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("__CURSOR=s=abc;i=1\n__REALTIME_TIMESTAMP=1549067421724300\nPRIORITY=3\n_HOSTNAME=machine.nl\n")
+	exportBinaryField(&buf, "MESSAGE", "panic: boom\n\ngoroutine 1 [running]:\n\tmain.main()")
+	buf.WriteString("SYSLOG_IDENTIFIER=app\n\n")
+	buf.WriteString("__CURSOR=s=abc;i=2\n")
+	exportBinaryField(&buf, "MESSAGE", "bell \a and = sign")
+	buf.WriteString("\n")
+
+	d := newExportDecoder(&buf)
+
+	var entry SystemdJournalEntry
+	AssertNotError(t, entry.decodeExport(d))
+	AssertEquals(t, "s=abc;i=1", entry.Cursor)
+	AssertEquals(t, int32(3), entry.Priority)
+
+	gelf := entry.toGelf()
+	AssertEquals(t, "machine.nl", gelf.Host)
+	AssertEquals(t, "app", gelf.Facility)
+	AssertEquals(t, "panic: boom", gelf.Short)
+	AssertEquals(t, "panic: boom\n\ngoroutine 1 [running]:\n\tmain.main()", gelf.Full)
+	AssertEquals(t, float64(1549067421.7243001), gelf.TimeUnix)
+
+	entry = SystemdJournalEntry{}
+	AssertNotError(t, entry.decodeExport(d))
+	AssertEquals(t, "s=abc;i=2", entry.Cursor)
+	AssertEquals(t, "bell \a and = sign", entry.Message)
+
+	AssertSpecificError(t, entry.decodeExport(d), io.EOF)
+}
+
+func TestDecodeTruncatedExportFormat(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("MESSAGE\n")
+	binary.Write(&buf, binary.LittleEndian, uint64(100))
+	buf.WriteString("too short")
+
+	var entry SystemdJournalEntry
+	AssertError(t, entry.decodeExport(newExportDecoder(&buf)))
+
+	_, err := newExportDecoder(bytes.NewBufferString("MESSAGE=no newline")).Decode()
+	AssertSpecificError(t, err, io.ErrUnexpectedEOF)
+}
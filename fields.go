@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Always sent as additional fields, like before forwarding other fields was possible
+var legacyFields = []string{"_BOOT_ID", "_PID", "_UID", "_SYSTEMD_UNIT"}
+
+// Already part of every GELF message as host, short_message, level, facility and timestamp
+var coreFields = map[string]bool{
+	"_HOSTNAME":            true,
+	"MESSAGE":              true,
+	"PRIORITY":             true,
+	"SYSLOG_IDENTIFIER":    true,
+	"__REALTIME_TIMESTAMP": true,
+}
+
+// GELF only allows these characters in additional field names
+var invalidFieldChars = regexp.MustCompile(`[^\w\.\-]`)
+
+// Selects which journal fields are sent as additional fields, using shell patterns like "_SYSTEMD_*",
+// and how they are named. Style is one of "legacy", "journal" or "lowercase"
+type fieldsConfig struct {
+	Style  string            `json:"style"`
+	Allow  []string          `json:"allow"`
+	Deny   []string          `json:"deny"`
+	Rename map[string]string `json:"rename"`
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *fieldsConfig) denied(field string) bool {
+	return matchesAny(this.Deny, field)
+}
+
+func (this *fieldsConfig) forwarded(field string) bool {
+	if coreFields[field] || !matchesAny(this.Allow, field) || this.denied(field) {
+		return false
+	}
+
+	for _, legacy := range legacyFields {
+		if field == legacy {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns a valid GELF field name, or false when the name is reserved
+func (this *fieldsConfig) name(field string) (string, bool) {
+	name, ok := this.Rename[field]
+	if !ok {
+		switch this.Style {
+		case "journal":
+			name = field
+		case "lowercase":
+			name = strings.ToLower(field)
+		default:
+			name = legacyName(field)
+		}
+	}
+
+	return gelfFieldName(name)
+}
+
+// Named like the fields this program always sent, so _SYSTEMD_UNIT becomes Systemd_unit
+func legacyName(field string) string {
+	name := strings.ToLower(strings.TrimLeft(field, "_"))
+	if name == "" {
+		return field
+	}
+
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// Additional fields must start with an underscore, which Graylog strips when storing them
+func gelfFieldName(name string) (string, bool) {
+	name = invalidFieldChars.ReplaceAllString(name, "_")
+	if !strings.HasPrefix(name, "_") {
+		name = "_" + name
+	}
+
+	if name == "_" || name == "_id" {
+		return "", false
+	}
+
+	return name, true
+}
+
+func (this *fieldsConfig) validate() error {
+	switch this.Style {
+	case "legacy", "journal", "lowercase":
+	default:
+		return fmt.Errorf("fields.style: unknown style %q, use legacy, journal or lowercase", this.Style)
+	}
+
+	for i, pattern := range this.Allow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("fields.allow[%d]: %s", i, err)
+		}
+	}
+
+	for i, pattern := range this.Deny {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("fields.deny[%d]: %s", i, err)
+		}
+	}
+
+	for field, name := range this.Rename {
+		if name == "" {
+			return fmt.Errorf("fields.rename.%s: must not be empty", field)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAllFieldsForwarded(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Fields.Allow = []string{"*"}
+	config.Fields.Deny = []string{"__*", "_CMDLINE"}
+	config.Fields.Rename = map[string]string{"CONTAINER_NAME": "container"}
+
+	entry := SystemdJournalEntry{}
+
+	err := json.Unmarshal([]byte(`{
+        "__CURSOR" : "s=abc;i=1",
+        "MESSAGE" : "started",
+        "_HOSTNAME" : "machine.nl",
+        "_COMM" : "nginx",
+        "_CMDLINE" : "nginx -g daemon off;",
+        "CODE_FILE" : "src/main.c",
+        "CONTAINER_NAME" : "web",
+        "_BOOT_ID" : "61c0e40c739f4f009c785cef13b46e17"
+	}`), &entry)
+
+	AssertNotError(t, err)
+
+	gelf := entry.toGelf()
+	AssertEquals(t, 7, len(gelf.Extra))
+	AssertEquals(t, "nginx", gelf.Extra["_Comm"])
+	AssertEquals(t, "src/main.c", gelf.Extra["_Code_file"])
+	AssertEquals(t, "web", gelf.Extra["_container"])
+	AssertEquals(t, "61c0e40c739f4f009c785cef13b46e17", gelf.Extra["_Boot_id"])
+	AssertEquals(t, nil, gelf.Extra["_Cmdline"])
+	AssertEquals(t, nil, gelf.Extra["_Cursor"])
+	AssertEquals(t, nil, gelf.Extra["_Message"])
+}
+
+func TestLegacyFieldsCanBeDenied(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Fields.Deny = []string{"_UID", "_PID"}
+
+	entry := SystemdJournalEntry{}
+
+	AssertNotError(t, json.Unmarshal([]byte(`{"MESSAGE" : "started", "_PID" : "1"}`), &entry))
+
+	gelf := entry.toGelf()
+	AssertEquals(t, 2, len(gelf.Extra))
+	AssertEquals(t, nil, gelf.Extra["_Pid"])
+}
+
+func TestFieldNameStyles(t *testing.T) {
+	fields := fieldsConfig{Style: "legacy", Rename: map[string]string{"MY_ID": "id", "WEIRD": "with space/slash"}}
+
+	for style, expected := range map[string]string{"legacy": "_Systemd_unit", "journal": "_SYSTEMD_UNIT", "lowercase": "_systemd_unit"} {
+		fields.Style = style
+		name, ok := fields.name("_SYSTEMD_UNIT")
+
+		AssertEquals(t, true, ok)
+		AssertEquals(t, expected, name)
+	}
+
+	fields.Style = "lowercase"
+	name, _ := fields.name("CODE_FILE")
+	AssertEquals(t, "_code_file", name)
+
+	name, _ = fields.name("WEIRD")
+	AssertEquals(t, "_with_space_slash", name)
+
+	_, ok := fields.name("MY_ID")
+	AssertEquals(t, false, ok)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// A test on the journal fields of an entry. Either combines other conditions with Not, All or Any,
+// or tests Field: every test that is set has to pass. Fields that are missing only pass Exists: false
+type conditionConfig struct {
+	Field  string   `json:"field"`
+	Equals *string  `json:"equals"`
+	In     []string `json:"in"`
+	Regex  string   `json:"regex"`
+	Gt     *float64 `json:"gt"`
+	Gte    *float64 `json:"gte"`
+	Lt     *float64 `json:"lt"`
+	Lte    *float64 `json:"lte"`
+	Exists *bool    `json:"exists"`
+
+	Not *conditionConfig  `json:"not"`
+	All []conditionConfig `json:"all"`
+	Any []conditionConfig `json:"any"`
+
+	regex *regexp.Regexp
+}
+
+// Rules are tried in order, the Action of the first one matching an entry decides whether it is
+// dropped or kept. Entries that match no rule are kept
+type filterConfig struct {
+	Name   string          `json:"name"`
+	When   conditionConfig `json:"when"`
+	Action string          `json:"action"`
+}
+
+func (this *conditionConfig) compile(key string) error {
+	combined := 0
+	if this.Not != nil {
+		combined++
+	}
+	if this.All != nil {
+		combined++
+	}
+	if this.Any != nil {
+		combined++
+	}
+
+	if combined > 1 || (combined == 1 && this.Field != "") {
+		return fmt.Errorf("%s: use only one of field, not, all and any", key)
+	}
+
+	switch {
+	case this.Not != nil:
+		return this.Not.compile(key + ".not")
+	case this.All != nil:
+		for i := range this.All {
+			if err := this.All[i].compile(fmt.Sprintf("%s.all[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case this.Any != nil:
+		for i := range this.Any {
+			if err := this.Any[i].compile(fmt.Sprintf("%s.any[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if this.Field == "" {
+		return fmt.Errorf("%s.field: is required", key)
+	}
+
+	if this.Equals == nil && this.In == nil && this.Regex == "" && this.Gt == nil && this.Gte == nil &&
+		this.Lt == nil && this.Lte == nil && this.Exists == nil {
+		return fmt.Errorf("%s: expected a test like equals, in, regex, gt, gte, lt, lte or exists", key)
+	}
+
+	if this.Regex != "" {
+		regex, err := regexp.Compile(this.Regex)
+		if err != nil {
+			return fmt.Errorf("%s.regex: %s", key, err)
+		}
+		this.regex = regex
+	}
+
+	return nil
+}
+
+func (this *conditionConfig) matches(fields map[string]string) bool {
+	switch {
+	case this.Not != nil:
+		return !this.Not.matches(fields)
+	case this.All != nil:
+		for i := range this.All {
+			if !this.All[i].matches(fields) {
+				return false
+			}
+		}
+		return true
+	case this.Any != nil:
+		for i := range this.Any {
+			if this.Any[i].matches(fields) {
+				return true
+			}
+		}
+		return false
+	}
+
+	value, ok := fields[this.Field]
+	if this.Exists != nil && *this.Exists != ok {
+		return false
+	} else if !ok {
+		return this.Exists != nil
+	}
+
+	if this.Equals != nil && value != *this.Equals {
+		return false
+	}
+
+	if this.In != nil {
+		found := false
+		for _, v := range this.In {
+			found = found || v == value
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if this.regex != nil && !this.regex.MatchString(value) {
+		return false
+	}
+
+	if this.Gt != nil || this.Gte != nil || this.Lt != nil || this.Lte != nil {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil ||
+			(this.Gt != nil && number <= *this.Gt) ||
+			(this.Gte != nil && number < *this.Gte) ||
+			(this.Lt != nil && number >= *this.Lt) ||
+			(this.Lte != nil && number > *this.Lte) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (this *filterConfig) validate(key string) error {
+	switch this.Action {
+	case "":
+		this.Action = "drop"
+	case "drop", "keep":
+	default:
+		return fmt.Errorf("%s.action: unknown action %q, use drop or keep", key, this.Action)
+	}
+
+	if this.Name == "" {
+		this.Name = key
+	}
+
+	return this.When.compile(key + ".when")
+}
+
+// Reports whether the first matching filter drops the entry, and counts it
+func filtered(entry *SystemdJournalEntry) bool {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	for i := range config.Filters {
+		filter := &config.Filters[i]
+		if !filter.When.matches(entry.Fields) {
+			continue
+		}
+
+		if filter.Action == "drop" {
+			metrics.entriesDropped.With(filter.Name).Inc()
+			return true
+		}
+
+		return false
+	}
+
+	return false
+}
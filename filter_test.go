@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFiltersDropDebugExceptImportantLines(t *testing.T) {
+	loaded, err := loadConfigString(t, `{
+		"destination": "localhost:12201",
+		"filters": [
+			{"name": "payments", "action": "keep", "when": {"field": "MESSAGE", "regex": "payment \\d+"}},
+			{"name": "api-debug", "when": {"all": [
+				{"field": "_SYSTEMD_UNIT", "equals": "api.service"},
+				{"field": "PRIORITY", "gte": 7}
+			]}},
+			{"name": "no-unit", "when": {"not": {"field": "_SYSTEMD_UNIT", "exists": true}}}
+		]
+	}`)
+	AssertNotError(t, err)
+
+	defer func(saved Config) { config = saved }(config)
+	config = loaded
+
+	dropped := metrics.entriesDropped.With("api-debug").Get()
+
+	for fields, expected := range map[*map[string]string]bool{
+		{"_SYSTEMD_UNIT": "api.service", "PRIORITY": "7", "MESSAGE": "cache miss"}:   true,
+		{"_SYSTEMD_UNIT": "api.service", "PRIORITY": "7", "MESSAGE": "payment 1234"}: false,
+		{"_SYSTEMD_UNIT": "api.service", "PRIORITY": "3", "MESSAGE": "cache miss"}:   false,
+		{"_SYSTEMD_UNIT": "db.service", "PRIORITY": "7", "MESSAGE": "cache miss"}:    false,
+		{"PRIORITY": "3", "MESSAGE": "kernel"}:                                       true,
+	} {
+		var entry SystemdJournalEntry
+		AssertNotError(t, entry.setFields(*fields))
+
+		if filtered(&entry) != expected {
+			t.Errorf("expected %v for %v", expected, *fields)
+		}
+	}
+
+	AssertEquals(t, dropped+1, metrics.entriesDropped.With("api-debug").Get())
+}
+
+func TestConditions(t *testing.T) {
+	fields := map[string]string{"PRIORITY": "4", "_COMM": "sshd", "CODE": "abc"}
+
+	for data, expected := range map[string]bool{
+		`{"field": "PRIORITY", "gt": 3, "lt": 5}`:                                           true,
+		`{"field": "PRIORITY", "lte": 3}`:                                                   false,
+		`{"field": "CODE", "gte": 1}`:                                                       false,
+		`{"field": "_COMM", "in": ["sshd", "sudo"]}`:                                        true,
+		`{"field": "MISSING", "exists": false}`:                                             true,
+		`{"field": "MISSING", "equals": ""}`:                                                false,
+		`{"any": [{"field": "_COMM", "equals": "cron"}, {"field": "CODE", "regex": "^a"}]}`: true,
+	} {
+		loaded, err := loadConfigString(t, `{"destination": "localhost:12201", "filters": [{"when": `+data+`}]}`)
+		AssertNotError(t, err)
+
+		if loaded.Filters[0].When.matches(fields) != expected {
+			t.Errorf("expected %v for %s", expected, data)
+		}
+	}
+}
+
+func TestFilterConfigErrors(t *testing.T) {
+	for data, expected := range map[string]string{
+		`{"action": "discard", "when": {"field": "A", "exists": true}}`:                                            "filters[0].action: unknown action",
+		`{"when": {"field": "A"}}`:                                                                                 "filters[0].when: expected a test",
+		`{"when": {"all": [{"field": "A", "regex": "("}]}}`:                                                        "filters[0].when.all[0].regex:",
+		`{"when": {"field": "A", "not": {"field": "B", "exists": true}}}`:                                          "filters[0].when: use only one of",
+		`{"when": {"field": "A", "gt": "3"}}`:                                                                      "filters[0].when.gt: expected a number",
+		`{"when": {"field": "A", "exists": true}}, {"name": "filters[0]", "when": {"field": "B", "exists": true}}`: "filters[1].name: \"filters[0]\" is already used",
+	} {
+		_, err := loadConfigString(t, `{"destination": "localhost:12201", "filters": [`+data+`]}`)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %s, got %v", expected, data, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Name is a template for the host of every message, like "{fqdn}" or "{hostname}.{os_release.ID}",
+// the _HOSTNAME of the entry by default. Labels are sent as additional fields with every message,
+// together with those in the *.conf files of LabelsDir, which have a KEY=VALUE on every line and
+// are read in order of their names. Labels in files win over those in the config
+type hostConfig struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	LabelsDir string            `json:"labels_dir"`
+
+	name   []hostPart
+	labels map[string]string
+}
+
+// Either literal text, or the value of a field of the entry
+type hostPart struct {
+	text  string
+	field string
+}
+
+var hostPlaceholder = regexp.MustCompile(`\{([a-z_]+(?:\.[A-Za-z0-9_]+)?)\}`)
+
+var osReleasePaths = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+func (this *hostConfig) compile(remote bool) error {
+	this.name = nil
+
+	var osRelease map[string]string
+	last := 0
+	for _, match := range hostPlaceholder.FindAllStringSubmatchIndex(this.Name, -1) {
+		this.name = append(this.name, hostPart{text: this.Name[last:match[0]]})
+		last = match[1]
+
+		placeholder := this.Name[match[2]:match[3]]
+		switch {
+		case placeholder == "hostname":
+			this.name = append(this.name, hostPart{field: "_HOSTNAME"})
+		case placeholder == "machine_id":
+			this.name = append(this.name, hostPart{field: "_MACHINE_ID"})
+		case remote && (placeholder == "fqdn" || strings.HasPrefix(placeholder, "os_release.")):
+			return fmt.Errorf("host.name: {%s} describes this machine, entries of the remote input keep the host of their sender", placeholder)
+		case placeholder == "fqdn":
+			fqdn, err := lookupFQDN()
+			if err != nil {
+				return fmt.Errorf("host.name: while looking up {fqdn}: %s", err)
+			}
+			this.name = append(this.name, hostPart{text: fqdn})
+		case strings.HasPrefix(placeholder, "os_release."):
+			if osRelease == nil {
+				var err error
+				if osRelease, err = readOsRelease(); err != nil {
+					return fmt.Errorf("host.name: while reading os-release: %s", err)
+				}
+			}
+
+			value, ok := osRelease[strings.TrimPrefix(placeholder, "os_release.")]
+			if !ok {
+				return fmt.Errorf("host.name: {%s} is not set in os-release", placeholder)
+			}
+			this.name = append(this.name, hostPart{text: value})
+		default:
+			return fmt.Errorf("host.name: unknown placeholder {%s}, use {hostname}, {fqdn}, {machine_id} or {os_release.NAME}", placeholder)
+		}
+	}
+	this.name = append(this.name, hostPart{text: this.Name[last:]})
+
+	return this.loadLabels()
+}
+
+func (this *hostConfig) loadLabels() error {
+	labels := make(map[string]string)
+	for key, value := range this.Labels {
+		labels[key] = value
+	}
+
+	if this.LabelsDir != "" {
+		files, err := filepath.Glob(filepath.Join(this.LabelsDir, "*.conf"))
+		if err != nil {
+			return fmt.Errorf("host.labels_dir: %s", err)
+		}
+		sort.Strings(files)
+
+		for _, file := range files {
+			values, err := readKeyValueFile(file)
+			if err != nil {
+				return fmt.Errorf("host.labels_dir: %s", err)
+			}
+
+			for key, value := range values {
+				labels[key] = value
+			}
+		}
+	}
+
+	this.labels = make(map[string]string, len(labels))
+	for key, value := range labels {
+		name, ok := gelfFieldName(key)
+		if !ok {
+			return fmt.Errorf("host.labels.%s: cannot be used as a field name", key)
+		}
+
+		this.labels[name] = value
+	}
+
+	return nil
+}
+
+// The host for the entry, its _HOSTNAME when no name is configured or the template is empty for it
+func (this *hostConfig) host(entry *SystemdJournalEntry) string {
+	if this.Name == "" {
+		return entry.Hostname
+	}
+
+	var host strings.Builder
+	for _, part := range this.name {
+		if part.field != "" {
+			host.WriteString(entry.Fields[part.field])
+		} else {
+			host.WriteString(part.text)
+		}
+	}
+
+	if host.Len() == 0 {
+		return entry.Hostname
+	}
+
+	return host.String()
+}
+
+// Like hostname -f, the canonical name of this machine, or its hostname when it has none
+var lookupFQDN = func() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	if cname, err := net.LookupCNAME(hostname); err == nil && strings.TrimSuffix(cname, ".") != "" {
+		return strings.TrimSuffix(cname, "."), nil
+	}
+
+	return hostname, nil
+}
+
+func readOsRelease() (map[string]string, error) {
+	var err error
+	for _, path := range osReleasePaths {
+		var values map[string]string
+		if values, err = readKeyValueFile(path); err == nil {
+			return values, nil
+		}
+	}
+
+	return nil, err
+}
+
+// Reads KEY=VALUE lines like those of os-release, values may be quoted. Empty lines and lines
+// starting with # are skipped
+func readKeyValueFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		eq := strings.IndexByte(text, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, line)
+		}
+
+		key, value := strings.TrimSpace(text[:eq]), strings.TrimSpace(text[eq+1:])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+
+		values[key] = value
+	}
+
+	return values, scanner.Err()
+}
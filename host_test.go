@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, data string) {
+	AssertNotError(t, ioutil.WriteFile(path, []byte(data), 0644))
+}
+
+func TestHostTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host")
+	AssertNotError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "os-release"), "# comment\nNAME=\"Debian GNU/Linux\"\nID=debian\nVERSION_ID='11'\n")
+	defer func(saved []string) { osReleasePaths = saved }(osReleasePaths)
+	osReleasePaths = []string{filepath.Join(dir, "missing"), filepath.Join(dir, "os-release")}
+
+	defer func(saved func() (string, error)) { lookupFQDN = saved }(lookupFQDN)
+	lookupFQDN = func() (string, error) { return "web1.ams.example.com", nil }
+
+	var entry SystemdJournalEntry
+	AssertNotError(t, entry.setFields(map[string]string{"_HOSTNAME": "web1", "_MACHINE_ID": "61c0e40c"}))
+
+	for name, expected := range map[string]string{
+		"":                        "web1",
+		"graylog-collector":       "graylog-collector",
+		"{fqdn}":                  "web1.ams.example.com",
+		"{hostname}-{machine_id}": "web1-61c0e40c",
+		"{hostname}.{os_release.ID}{os_release.VERSION_ID}": "web1.debian11",
+	} {
+		host := hostConfig{Name: name}
+		AssertNotError(t, host.compile(false))
+		AssertEquals(t, expected, host.host(&entry))
+	}
+
+	// the template is empty for entries without a machine id
+	host := hostConfig{Name: "{machine_id}"}
+	AssertNotError(t, host.compile(false))
+	AssertNotError(t, entry.setFields(map[string]string{"_HOSTNAME": "web2"}))
+	AssertEquals(t, "web2", host.host(&entry))
+}
+
+func TestHostTemplateErrors(t *testing.T) {
+	defer func(saved []string) { osReleasePaths = saved }(osReleasePaths)
+	osReleasePaths = []string{"/nonexistent/os-release"}
+
+	for _, test := range []struct {
+		name     string
+		remote   bool
+		expected string
+	}{
+		{"{domain}", false, "host.name: unknown placeholder {domain}, use {hostname}, {fqdn}, {machine_id} or {os_release.NAME}"},
+		{"{os_release.ID}", false, "host.name: while reading os-release: "},
+		{"{fqdn}", true, "host.name: {fqdn} describes this machine, entries of the remote input keep the host of their sender"},
+		{"{os_release.ID}", true, "host.name: {os_release.ID} describes this machine"},
+	} {
+		host := hostConfig{Name: test.name}
+		err := host.compile(test.remote)
+		if err == nil || !strings.HasPrefix(err.Error(), test.expected) {
+			t.Errorf("expected error %q, got %v", test.expected, err)
+		}
+	}
+}
+
+func TestHostLabels(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	dir, err := ioutil.TempDir("", "labels")
+	AssertNotError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "10-site.conf"), "datacenter=ams1\nrole = web\n")
+	writeFile(t, filepath.Join(dir, "20-override.conf"), "# later files win\nrole=\"web frontend\"\n")
+	writeFile(t, filepath.Join(dir, "README"), "not=read\n")
+
+	config.Host = hostConfig{Labels: map[string]string{"environment": "production", "role": "unknown"}, LabelsDir: dir}
+	AssertNotError(t, config.Host.compile(false))
+
+	var entry SystemdJournalEntry
+	AssertNotError(t, entry.setFields(map[string]string{"_HOSTNAME": "web1", "MESSAGE": "hello"}))
+
+	message := entry.toGelf()
+	AssertEquals(t, "production", message.Extra["_environment"])
+	AssertEquals(t, "ams1", message.Extra["_datacenter"])
+	AssertEquals(t, "web frontend", message.Extra["_role"])
+	AssertEquals(t, nil, message.Extra["_not"])
+
+	writeFile(t, filepath.Join(dir, "30-broken.conf"), "just text\n")
+	err = config.Host.compile(false)
+	if err == nil || !strings.Contains(err.Error(), "30-broken.conf:1: expected KEY=VALUE") {
+		t.Errorf("expected an error about the broken file, got %v", err)
+	}
+}
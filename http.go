@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Options for http:// and https:// destinations, which post to /gelf unless they have another
+// path. Requests that fail or get a 5xx or 429 response are tried Retries more times. With Bulk,
+// batches are posted as newline delimited messages in a single request, which needs Graylog 5
+// or later with bulk receiving enabled on the input
+type httpOptions struct {
+	Gzip     bool     `json:"gzip"`
+	Bulk     bool     `json:"bulk"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Token    string   `json:"token"`
+	Timeout  duration `json:"timeout"`
+	Retries  int      `json:"retries"`
+}
+
+const (
+	HTTP_TIMEOUT         = 10 * time.Second
+	HTTP_RETRIES         = 3
+	HTTP_RETRY_DELAY     = 1 * time.Second
+	HTTP_MAX_RETRY_DELAY = 1 * time.Minute
+	HTTP_DEFAULT_PATH    = "/gelf"
+)
+
+var defaultHTTPOptions = httpOptions{Timeout: duration{HTTP_TIMEOUT}, Retries: HTTP_RETRIES}
+
+// Graylog answered with a 4xx other than 429, sending the same message again won't help
+type rejectedError struct {
+	error
+}
+
+// Writers that can send several messages at once, used for the batches of the sender and when
+// draining a spool. Returns how many of the messages were sent, all of them unless there is an error
+type batchWriter interface {
+	WriteMessages(messages []*gelf.Message) (int, error)
+}
+
+func (this *httpOptions) validate(key string) error {
+	if this.Token != "" && (this.Username != "" || this.Password != "") {
+		return fmt.Errorf("%s: cannot be combined with %s", joinKey(key, "http.token"), joinKey(key, "http.username"))
+	}
+
+	if this.Timeout.Duration < 0 {
+		return fmt.Errorf("%s: must not be negative", joinKey(key, "http.timeout"))
+	}
+
+	if this.Retries < 0 {
+		return fmt.Errorf("%s: must not be negative", joinKey(key, "http.retries"))
+	}
+
+	return nil
+}
+
+// Posts GELF messages to a Graylog HTTP input
+type httpWriter struct {
+	client    *http.Client
+	url       string
+	options   httpOptions
+	hostname  string
+	bytesSent *counter
+}
+
+func newHTTPWriter(address string, tlsOptions tlsOptions, options httpOptions) (*httpWriter, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Path == "" {
+		u.Path = HTTP_DEFAULT_PATH
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if u.Scheme == "https" {
+		if transport.TLSClientConfig, err = tlsOptions.tlsConfig(u.Host); err != nil {
+			return nil, err
+		}
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &httpWriter{
+		client:    &http.Client{Transport: transport, Timeout: options.Timeout.Duration},
+		url:       u.String(),
+		options:   options,
+		hostname:  hostname,
+		bytesSent: metrics.bytesSent.With(u.Scheme),
+	}, nil
+}
+
+func (this *httpWriter) WriteMessage(m *gelf.Message) error {
+	_, err := this.WriteMessages([]*gelf.Message{m})
+	return err
+}
+
+func (this *httpWriter) WriteMessages(messages []*gelf.Message) (int, error) {
+	if !this.options.Bulk {
+		return this.writeEach(messages)
+	}
+
+	var buf bytes.Buffer
+	for i, m := range messages {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		if err := m.MarshalJSONBuf(&buf); err != nil {
+			return 0, err
+		}
+	}
+
+	err := this.post(buf.Bytes())
+	if _, rejected := err.(rejectedError); rejected && len(messages) > 1 {
+		// find out which of the messages was rejected
+		return this.writeEach(messages)
+	} else if err != nil {
+		return 0, err
+	}
+
+	return len(messages), nil
+}
+
+// Posts the messages one at a time
+func (this *httpWriter) writeEach(messages []*gelf.Message) (int, error) {
+	for i, m := range messages {
+		var buf bytes.Buffer
+		if err := m.MarshalJSONBuf(&buf); err != nil {
+			return i, err
+		}
+
+		if err := this.post(buf.Bytes()); err != nil {
+			return i, err
+		}
+	}
+
+	return len(messages), nil
+}
+
+// Retries failed requests and those that got a 5xx or 429 response, waiting as long as the
+// server asks for with Retry-After
+func (this *httpWriter) post(body []byte) error {
+	if this.options.Gzip {
+		var compressed bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&compressed, flate.BestSpeed)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		body = compressed.Bytes()
+	}
+
+	delay := HTTP_RETRY_DELAY
+	for attempt := 0; ; attempt++ {
+		retry, retryAfter, err := this.request(body)
+		if err == nil || !retry || attempt >= this.options.Retries {
+			return err
+		}
+
+		if retryAfter >= 0 {
+			delay = retryAfter
+		}
+		if delay > HTTP_MAX_RETRY_DELAY {
+			delay = HTTP_MAX_RETRY_DELAY
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Reports whether a failed request can be retried, and after how long the server asked for, or -1
+func (this *httpWriter) request(body []byte) (bool, time.Duration, error) {
+	req, err := http.NewRequest("POST", this.url, bytes.NewReader(body))
+	if err != nil {
+		return false, -1, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if this.options.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if this.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+this.options.Token)
+	} else if this.options.Username != "" {
+		req.SetBasicAuth(this.options.Username, this.options.Password)
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return true, -1, err
+	}
+	defer resp.Body.Close()
+
+	text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	// read the rest so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		this.bytesSent.Add(uint64(len(body)))
+		return false, -1, nil
+	}
+
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(text))
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return false, -1, rejectedError{err}
+	}
+
+	return true, retryAfter(resp.Header.Get("Retry-After")), err
+}
+
+// Seconds or a date, -1 when missing or invalid
+func retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+		return 0
+	}
+
+	return -1
+}
+
+func (this *httpWriter) Write(p []byte) (int, error) {
+	if err := this.WriteMessage(newTextMessage(this.hostname, p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (this *httpWriter) Close() error {
+	this.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/pem"
+	"errors"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type httpRequest struct {
+	path, authorization, encoding string
+	body                          string
+}
+
+// Records requests, answering with the statuses in order and 202 Accepted after those
+type graylogHTTPInput struct {
+	sync.Mutex
+	requests []httpRequest
+	statuses []int
+}
+
+func (this *graylogHTTPInput) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	data, _ := ioutil.ReadAll(body)
+
+	this.Lock()
+	defer this.Unlock()
+
+	this.requests = append(this.requests, httpRequest{
+		path:          r.URL.Path,
+		authorization: r.Header.Get("Authorization"),
+		encoding:      r.Header.Get("Content-Encoding"),
+		body:          string(data),
+	})
+
+	if len(this.statuses) > 0 {
+		status := this.statuses[0]
+		this.statuses = this.statuses[1:]
+
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(status)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func testMessages(shorts ...string) []*gelf.Message {
+	var messages []*gelf.Message
+	for _, short := range shorts {
+		messages = append(messages, &gelf.Message{Version: "1.1", Host: "web1", Short: short, Extra: map[string]interface{}{}})
+	}
+
+	return messages
+}
+
+func TestHTTPWriterPostsCompressedBulkMessages(t *testing.T) {
+	input := &graylogHTTPInput{}
+	server := httptest.NewServer(input)
+	defer server.Close()
+
+	options := defaultHTTPOptions
+	options.Gzip, options.Bulk, options.Token = true, true, "secret"
+
+	w, err := newWriter(server.URL, tlsOptions{}, options)
+	AssertNotError(t, err)
+	defer w.Close()
+
+	n, err := w.(batchWriter).WriteMessages(testMessages("first", "second"))
+	AssertNotError(t, err)
+	AssertEquals(t, 2, n)
+
+	AssertEquals(t, 1, len(input.requests))
+	AssertEquals(t, "/gelf", input.requests[0].path)
+	AssertEquals(t, "Bearer secret", input.requests[0].authorization)
+	AssertEquals(t, "gzip", input.requests[0].encoding)
+
+	lines := strings.Split(input.requests[0].body, "\n")
+	AssertEquals(t, 2, len(lines))
+	AssertEquals(t, true, strings.Contains(lines[0], `"short_message":"first"`))
+	AssertEquals(t, true, strings.Contains(lines[1], `"short_message":"second"`))
+}
+
+func TestHTTPWriterRetriesServerErrors(t *testing.T) {
+	input := &graylogHTTPInput{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(input)
+	defer server.Close()
+
+	options := defaultHTTPOptions
+	options.Username, options.Password = "graylog", "hunter2"
+
+	w, err := newWriter(server.URL+"/custom", tlsOptions{}, options)
+	AssertNotError(t, err)
+
+	AssertNotError(t, w.WriteMessage(testMessages("retried")[0]))
+	AssertEquals(t, 3, len(input.requests))
+	AssertEquals(t, "/custom", input.requests[2].path)
+	AssertEquals(t, "Basic Z3JheWxvZzpodW50ZXIy", input.requests[2].authorization)
+	AssertEquals(t, "", input.requests[2].encoding)
+
+	// client errors are not retried, and messages after a failed one are not sent
+	input.statuses = []int{http.StatusBadRequest}
+	n, err := w.(batchWriter).WriteMessages(testMessages("rejected", "next"))
+	AssertEquals(t, 0, n)
+	if err == nil || !strings.HasPrefix(err.Error(), "400 Bad Request") {
+		t.Errorf("expected a 400 error, got %v", err)
+	}
+	AssertEquals(t, 4, len(input.requests))
+
+	// giving up after the retries
+	options.Retries = 1
+	w, err = newWriter(server.URL, tlsOptions{}, options)
+	AssertNotError(t, err)
+
+	input.statuses = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}
+	AssertError(t, w.WriteMessage(testMessages("lost")[0]))
+	AssertEquals(t, 6, len(input.requests))
+}
+
+func TestHTTPWriterTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	options := defaultHTTPOptions
+	options.Timeout.Duration, options.Retries = 20*time.Millisecond, 0
+
+	w, err := newWriter(server.URL, tlsOptions{}, options)
+	AssertNotError(t, err)
+
+	AssertError(t, w.WriteMessage(testMessages("slow")[0]))
+}
+
+func TestHTTPSWriterVerifiesServer(t *testing.T) {
+	input := &graylogHTTPInput{}
+	server := httptest.NewTLSServer(input)
+	defer server.Close()
+
+	ca, err := ioutil.TempFile("", "ca")
+	AssertNotError(t, err)
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	ca.Close()
+
+	w, err := newWriter(server.URL, tlsOptions{CA: ca.Name()}, defaultHTTPOptions)
+	AssertNotError(t, err)
+	AssertNotError(t, w.WriteMessage(testMessages("secure")[0]))
+	AssertEquals(t, 1, len(input.requests))
+
+	options := defaultHTTPOptions
+	options.Retries = 0
+	w, err = newWriter(server.URL, tlsOptions{}, options)
+	AssertNotError(t, err)
+	AssertError(t, w.WriteMessage(testMessages("untrusted")[0]))
+}
+
+func TestRetryAfter(t *testing.T) {
+	AssertEquals(t, 5*time.Second, retryAfter("5"))
+	AssertEquals(t, time.Duration(-1), retryAfter(""))
+	AssertEquals(t, time.Duration(-1), retryAfter("soon"))
+	AssertEquals(t, time.Duration(0), retryAfter("Wed, 21 Oct 2015 07:28:00 GMT"))
+
+	delay := retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if delay < 58*time.Second || delay > time.Minute {
+		t.Errorf("expected about a minute, got %s", delay)
+	}
+}
+
+func TestRejectedMessagesAreDropped(t *testing.T) {
+	input := &graylogHTTPInput{statuses: []int{http.StatusBadRequest, http.StatusAccepted, http.StatusRequestEntityTooLarge}}
+	server := httptest.NewServer(input)
+	defer server.Close()
+
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": {}})()
+	config.Timing.SleepAfterError.Duration = time.Hour
+
+	options := defaultHTTPOptions
+	options.Bulk = true
+
+	w, err := newWriter(server.URL, tlsOptions{}, options)
+	AssertNotError(t, err)
+	defer w.Close()
+
+	output := outputs["default"]
+	output.writer = w
+
+	var batch []outbound
+	for _, message := range testMessages("first", "too large", "third") {
+		batch = append(batch, outbound{message: message})
+	}
+
+	rejected := metrics.messagesRejected.With("default").Get()
+	AssertEquals(t, true, output.writeMessages(batch))
+	AssertEquals(t, rejected+1, metrics.messagesRejected.With("default").Get())
+	AssertEquals(t, true, output.healthy())
+
+	// the bulk request, the messages one at a time until the rejected one, and the rest
+	AssertEquals(t, 4, len(input.requests))
+	AssertEquals(t, true, strings.Contains(input.requests[1].body, `"short_message":"first"`))
+	AssertEquals(t, true, strings.Contains(input.requests[2].body, `"short_message":"too large"`))
+	AssertEquals(t, true, strings.Contains(input.requests[3].body, `"short_message":"third"`))
+}
+
+// Sends the first messages of every batch, failing once after that
+type partialBatchWriter struct {
+	recordingWriter
+	failures int
+}
+
+func (this *partialBatchWriter) WriteMessages(messages []*gelf.Message) (int, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.failures > 0 && len(messages) > 1 {
+		this.failures--
+		this.messages = append(this.messages, messages[0])
+		return 1, errors.New("connection reset")
+	}
+
+	this.messages = append(this.messages, messages...)
+
+	return len(messages), nil
+}
+
+func TestBatchesAreResumedAfterPartialFailures(t *testing.T) {
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": {}})()
+	config.Timing.SleepAfterError.Duration = time.Millisecond
+
+	w := &partialBatchWriter{failures: 2}
+	outputs["default"].writer = w
+
+	var batch []outbound
+	for _, message := range testMessages("1", "2", "3", "4") {
+		batch = append(batch, outbound{message: message})
+	}
+	outputs["default"].writeMessages(batch)
+
+	AssertEquals(t, 4, len(w.messages))
+	for i, message := range w.messages {
+		AssertEquals(t, string(rune('1'+i)), message.Short)
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Produces journal entries until io.EOF, which only happens when not following the journal
+type journalReader interface {
+	Next() (SystemdJournalEntry, error)
+	Close() error
+}
+
+// Inputs that can be selected with journal.input, optional ones register themselves when compiled in
+var journalInputs = map[string]func(config journalConfig, cursor *cursorState) (journalReader, error){
+	"journalctl": newJournalctlReader,
+}
+
+// Prefixes understood by journald when written at the start of a line on stderr, see sd-daemon(3)
+const (
+	SD_ERR     = "<3>"
+	SD_WARNING = "<4>"
+	SD_NOTICE  = "<5>"
+)
+
+const (
+	JOURNALCTL_RESTART_DELAY     = 1 * time.Second
+	JOURNALCTL_MAX_RESTART_DELAY = 1 * time.Minute
+	INPUT_REOPEN_DELAY           = 1 * time.Second
+	INPUT_MAX_REOPEN_DELAY       = 1 * time.Minute
+)
+
+// Reads the json or export format output of a journalctl child process, which is restarted
+// with an increasing delay when it exits unexpectedly or its output can't be parsed
+type journalctlReader struct {
+	sync.Mutex
+	config journalConfig
+	cursor *cursorState
+	cmd    *exec.Cmd
+	stderr chan struct{}
+	decode func(entry *SystemdJournalEntry) error
+	// cursor of the last returned entry, every entry up to it was either sent or is still pending
+	last      string
+	started   time.Time
+	delay     time.Duration
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newJournalctlReader(config journalConfig, cursor *cursorState) (journalReader, error) {
+	this := &journalctlReader{
+		config: config,
+		cursor: cursor,
+		delay:  JOURNALCTL_RESTART_DELAY,
+		closed: make(chan struct{}),
+	}
+
+	// fail right away when journalctl can't be started at all, instead of retrying forever
+	if err := this.start(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+func (this *journalctlReader) args() []string {
+	args := []string{"--all", "--output=" + this.config.Format}
+	args = append(args, this.config.Args...)
+	if this.config.Follow {
+		args = append(args, "--follow")
+	}
+	args = append(args, this.config.Matches...)
+
+	if this.last != "" {
+		return afterCursorArgs(args, this.last)
+	}
+
+	return this.cursor.journalArgs(args)
+}
+
+func (this *journalctlReader) start() error {
+	cmd := exec.Command("journalctl", this.args()...)
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	select {
+	case <-this.closed:
+		return io.EOF
+	default:
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	this.cmd = cmd
+	this.started = time.Now()
+	this.stderr = make(chan struct{})
+
+	go copyStderr(cmd.Process.Pid, stderr, this.stderr)
+
+	if this.config.Format == "export" {
+		d := newExportDecoder(stdout)
+		this.decode = func(entry *SystemdJournalEntry) error {
+			for {
+				fields, err := d.Decode()
+				if err != nil {
+					// the position in the stream is lost, so journalctl needs a restart
+					return err
+				}
+
+				if err = entry.setFields(fields); err == nil {
+					return nil
+				}
+
+				this.skipped(err)
+			}
+		}
+	} else {
+		// journalctl writes one entry per line, which allows skipping a line that can't be decoded
+		r := bufio.NewReader(stdout)
+		this.decode = func(entry *SystemdJournalEntry) error {
+			for {
+				line, err := r.ReadBytes('\n')
+				if err == io.EOF && len(bytes.TrimSpace(line)) > 0 {
+					err = io.ErrUnexpectedEOF
+				}
+				if err != nil {
+					return err
+				}
+
+				if len(bytes.TrimSpace(line)) == 0 {
+					continue
+				}
+
+				if err = json.Unmarshal(line, entry); err == nil {
+					return nil
+				}
+
+				*entry = SystemdJournalEntry{}
+				this.skipped(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Logs a line of journalctl's stderr, so it's clear where it came from and how severe it is
+func copyStderr(pid int, stderr io.Reader, done chan struct{}) {
+	defer close(done)
+
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		fmt.Fprintf(os.Stderr, "%sjournalctl[%d]: %s\n", SD_WARNING, pid, scanner.Text())
+	}
+}
+
+func (this *journalctlReader) logf(level, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%sjournalctl[%d]: %s\n", level, this.cmd.Process.Pid, fmt.Sprintf(format, args...))
+}
+
+func (this *journalctlReader) skipped(err error) {
+	metrics.parseFailures.Inc()
+	this.logf(SD_WARNING, "skipping entry that could not be parsed: %s", err)
+}
+
+func (this *journalctlReader) Next() (SystemdJournalEntry, error) {
+	for {
+		var entry SystemdJournalEntry
+		err := this.decode(&entry)
+		if err == nil {
+			this.last = entry.Cursor
+			return entry, nil
+		}
+
+		if err != io.EOF {
+			metrics.parseFailures.Inc()
+			this.logf(SD_ERR, "could not parse output: %s", err)
+		}
+
+		exit := this.stop(err != io.EOF)
+
+		select {
+		case <-this.closed:
+			return SystemdJournalEntry{}, io.EOF
+		default:
+		}
+
+		// without --follow, journalctl exits by itself after the last entry
+		if err == io.EOF && exit == nil && !this.config.Follow {
+			return SystemdJournalEntry{}, io.EOF
+		}
+
+		if exit == nil {
+			exit = errors.New("exited")
+		}
+
+		if err := this.restart(exit); err != nil {
+			return SystemdJournalEntry{}, err
+		}
+	}
+}
+
+// Kills journalctl when requested and waits for it to exit
+func (this *journalctlReader) stop(kill bool) error {
+	if kill {
+		this.cmd.Process.Kill()
+	}
+
+	// stderr has to be read completely before waiting, see exec.Cmd.StderrPipe
+	<-this.stderr
+
+	return this.cmd.Wait()
+}
+
+// Starts journalctl again after a delay, which doubles every time it exits shortly after starting
+func (this *journalctlReader) restart(exit error) error {
+	if time.Since(this.started) > JOURNALCTL_MAX_RESTART_DELAY {
+		this.delay = JOURNALCTL_RESTART_DELAY
+	}
+
+	for {
+		this.logf(SD_WARNING, "%s, restarting in %s", exit, this.delay)
+
+		select {
+		case <-this.closed:
+			return io.EOF
+		case <-time.After(this.delay):
+		}
+
+		this.delay *= 2
+		if this.delay > JOURNALCTL_MAX_RESTART_DELAY {
+			this.delay = JOURNALCTL_MAX_RESTART_DELAY
+		}
+
+		metrics.journalctlRestarts.Inc()
+
+		exit = this.start()
+		if exit == nil || exit == io.EOF {
+			return exit
+		}
+	}
+}
+
+// Stops journalctl and any pending restart, a blocked Next returns io.EOF
+func (this *journalctlReader) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+
+	this.Lock()
+	defer this.Unlock()
+
+	// fails when journalctl already exited, which is fine
+	this.cmd.Process.Kill()
+
+	return nil
+}
+
+// Reopens an input that fails, after the last entry it returned, with a delay that doubles every
+// time it fails shortly after opening. journalctl restarts itself, so this mostly covers the
+// other inputs. Only opening the input the first time is fatal
+type supervisedReader struct {
+	sync.Mutex
+	input     string
+	open      func(cursor *cursorState) (journalReader, error)
+	reader    journalReader
+	last      string
+	opened    time.Time
+	delay     time.Duration
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func openJournal(config journalConfig, cursor *cursorState) (journalReader, error) {
+	open := func(cursor *cursorState) (journalReader, error) {
+		return journalInputs[config.Input](config, cursor)
+	}
+
+	reader, err := open(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	return &supervisedReader{
+		input:  config.Input,
+		open:   open,
+		reader: reader,
+		last:   cursor.Get(),
+		opened: time.Now(),
+		delay:  INPUT_REOPEN_DELAY,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+func (this *supervisedReader) Next() (SystemdJournalEntry, error) {
+	for {
+		this.Lock()
+		reader := this.reader
+		this.Unlock()
+
+		entry, err := reader.Next()
+		if err == nil {
+			if entry.Cursor != "" {
+				this.last = entry.Cursor
+			}
+			return entry, nil
+		} else if err == io.EOF {
+			return entry, err
+		}
+
+		this.Lock()
+		reader.Close()
+		this.Unlock()
+
+		if err := this.reopen(err); err != nil {
+			return SystemdJournalEntry{}, err
+		}
+	}
+}
+
+// Returns io.EOF when closed while waiting
+func (this *supervisedReader) reopen(cause error) error {
+	if time.Since(this.opened) > INPUT_MAX_REOPEN_DELAY {
+		this.delay = INPUT_REOPEN_DELAY
+	}
+
+	for {
+		fmt.Fprintf(os.Stderr, "journal - input %s failed because of: %s, reopening in %s\n", this.input, cause, this.delay)
+
+		select {
+		case <-this.closed:
+			return io.EOF
+		case <-time.After(this.delay):
+		}
+
+		this.delay *= 2
+		if this.delay > INPUT_MAX_REOPEN_DELAY {
+			this.delay = INPUT_MAX_REOPEN_DELAY
+		}
+
+		metrics.inputReopens.Inc()
+
+		// a fresh state, so the input continues after the last entry read rather than the last one sent
+		reader, err := this.open(&cursorState{current: this.last})
+		if err != nil {
+			cause = err
+			continue
+		}
+
+		this.Lock()
+		defer this.Unlock()
+
+		select {
+		case <-this.closed:
+			reader.Close()
+			return io.EOF
+		default:
+		}
+
+		this.reader = reader
+		this.opened = time.Now()
+
+		return nil
+	}
+}
+
+func (this *supervisedReader) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+
+	this.Lock()
+	defer this.Unlock()
+
+	return this.reader.Close()
+}
+
+func (this *journalConfig) validate() error {
+	if _, ok := journalInputs[this.Input]; !ok {
+		var inputs []string
+		for input := range journalInputs {
+			inputs = append(inputs, input)
+		}
+		sort.Strings(inputs)
+
+		return fmt.Errorf("journal.input: unknown or not compiled in input %q, use one of %s", this.Input, strings.Join(inputs, ", "))
+	}
+
+	if len(this.Args) > 0 && this.Input != "journalctl" {
+		return fmt.Errorf("journal.args: only supported by the journalctl input")
+	}
+
+	if len(this.Matches) > 0 && this.Input == "remote" {
+		return fmt.Errorf("journal.matches: not supported by the remote input")
+	}
+
+	switch this.Format {
+	case "json", "export":
+	default:
+		return fmt.Errorf("journal.format: unknown format %q, use json or export", this.Format)
+	}
+
+	if this.Format != "json" && this.Input != "journalctl" {
+		return fmt.Errorf("journal.format: only supported by the journalctl input")
+	}
+
+	for i, match := range this.Matches {
+		if match != "+" && strings.Index(match, "=") < 1 {
+			return fmt.Errorf("journal.matches[%d]: expected FIELD=value or +", i)
+		}
+	}
+
+	return nil
+}
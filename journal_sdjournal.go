@@ -0,0 +1,171 @@
+//go:build sdjournal
+// +build sdjournal
+
+package main
+
+/*
+#cgo pkg-config: libsystemd
+#include <stdlib.h>
+#include <systemd/sd-journal.h>
+*/
+import "C"
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func init() {
+	journalInputs["sdjournal"] = newSdJournalReader
+}
+
+// The sd_journal calls behind sdJournalReader, see sdjournal.go
+type cJournal struct {
+	journal *C.sd_journal
+}
+
+func sdError(r C.int) error {
+	return syscall.Errno(-r)
+}
+
+func newSdJournalReader(config journalConfig, cursor *cursorState) (journalReader, error) {
+	this := &cJournal{}
+
+	if r := C.sd_journal_open(&this.journal, C.SD_JOURNAL_LOCAL_ONLY); r < 0 {
+		return nil, sdError(r)
+	}
+
+	// don't truncate large fields
+	C.sd_journal_set_data_threshold(this.journal, 0)
+
+	for _, match := range config.Matches {
+		var r C.int
+
+		if match == "+" {
+			r = C.sd_journal_add_disjunction(this.journal)
+		} else {
+			cs := C.CString(match)
+			r = C.sd_journal_add_match(this.journal, unsafe.Pointer(cs), C.size_t(len(match)))
+			C.free(unsafe.Pointer(cs))
+		}
+
+		if r < 0 {
+			this.Close()
+			return nil, sdError(r)
+		}
+	}
+
+	reader, err := newSdJournalReaderAt(this, config.Follow, cursor.Get())
+	if err != nil {
+		this.Close()
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+func (this *cJournal) SeekHead() error {
+	if r := C.sd_journal_seek_head(this.journal); r < 0 {
+		return sdError(r)
+	}
+
+	return nil
+}
+
+func (this *cJournal) SeekTail() error {
+	if r := C.sd_journal_seek_tail(this.journal); r < 0 {
+		return sdError(r)
+	}
+
+	return nil
+}
+
+func (this *cJournal) SeekCursor(cursor string) error {
+	cs := C.CString(cursor)
+	defer C.free(unsafe.Pointer(cs))
+
+	if r := C.sd_journal_seek_cursor(this.journal, cs); r < 0 {
+		return sdError(r)
+	}
+
+	return nil
+}
+
+func (this *cJournal) TestCursor(cursor string) bool {
+	cs := C.CString(cursor)
+	defer C.free(unsafe.Pointer(cs))
+
+	return C.sd_journal_test_cursor(this.journal, cs) > 0
+}
+
+func (this *cJournal) Next() (bool, error) {
+	r := C.sd_journal_next(this.journal)
+	if r < 0 {
+		return false, sdError(r)
+	}
+
+	return r > 0, nil
+}
+
+func (this *cJournal) Previous() error {
+	if r := C.sd_journal_previous(this.journal); r < 0 {
+		return sdError(r)
+	}
+
+	return nil
+}
+
+func (this *cJournal) Wait(timeout time.Duration) error {
+	if r := C.sd_journal_wait(this.journal, C.uint64_t(timeout/time.Microsecond)); r < 0 {
+		return sdError(r)
+	}
+
+	return nil
+}
+
+func (this *cJournal) Data() ([][]byte, error) {
+	var data [][]byte
+	var field unsafe.Pointer
+	var length C.size_t
+
+	C.sd_journal_restart_data(this.journal)
+	for {
+		r := C.sd_journal_enumerate_data(this.journal, &field, &length)
+		if r < 0 {
+			return nil, sdError(r)
+		} else if r == 0 {
+			return data, nil
+		}
+
+		data = append(data, C.GoBytes(field, C.int(length)))
+	}
+}
+
+func (this *cJournal) Cursor() (string, error) {
+	var cursor *C.char
+	if r := C.sd_journal_get_cursor(this.journal, &cursor); r < 0 {
+		return "", sdError(r)
+	}
+	defer C.free(unsafe.Pointer(cursor))
+
+	return C.GoString(cursor), nil
+}
+
+func (this *cJournal) Realtime() (uint64, error) {
+	var realtime C.uint64_t
+	if r := C.sd_journal_get_realtime_usec(this.journal, &realtime); r < 0 {
+		return 0, sdError(r)
+	}
+
+	return uint64(realtime), nil
+}
+
+func (this *cJournal) Close() error {
+	if this.journal != nil {
+		C.sd_journal_close(this.journal)
+		this.journal = nil
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestJournalConfigValidation(t *testing.T) {
+	AssertNotError(t, (&journalConfig{Input: "journalctl", Format: "json", Matches: []string{"_SYSTEMD_UNIT=a.service", "+", "_TRANSPORT=kernel"}}).validate())
+
+	AssertError(t, (&journalConfig{Input: "journalctl", Format: "json", Matches: []string{"_SYSTEMD_UNIT"}}).validate())
+	AssertError(t, (&journalConfig{Input: "files", Format: "json"}).validate())
+	AssertError(t, (&journalConfig{Input: "journalctl", Format: "cat"}).validate())
+
+	if _, ok := journalInputs["sdjournal"]; ok {
+		AssertError(t, (&journalConfig{Input: "sdjournal", Format: "json", Args: []string{"--merge"}}).validate())
+	}
+}
+
+// Puts a journalctl script in PATH which prints the output of the next run each time it's started
+func fakeJournalctl(t *testing.T, runs ...string) (string, func()) {
+	dir, err := ioutil.TempDir("", "journalctl")
+	AssertNotError(t, err)
+
+	script := "#!/bin/sh\nrun=$(cat \"$0.run\" 2>/dev/null || echo 0)\necho $((run + 1)) > \"$0.run\"\necho \"$@\" >> \"$0.args\"\n"
+	for i, run := range runs {
+		script += "[ $run = " + strconv.Itoa(i) + " ] && { " + run + "; }\n"
+	}
+	AssertNotError(t, ioutil.WriteFile(filepath.Join(dir, "journalctl"), []byte(script), 0755))
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+path)
+
+	return filepath.Join(dir, "journalctl.args"), func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestJournalctlRestartedAfterFailure(t *testing.T) {
+	argsFile, cleanup := fakeJournalctl(t,
+		`echo '{"__CURSOR":"c1","MESSAGE":"one"}'; echo 'not json'; echo '{"__CURSOR":"c2","MESSAGE":"two"}'; echo 'Failed' >&2; exit 1`,
+		`echo '{"__CURSOR":"c3","MESSAGE":"three"}'`,
+	)
+	defer cleanup()
+
+	failures := metrics.parseFailures.Get()
+	restarts := metrics.journalctlRestarts.Get()
+
+	reader, err := newJournalctlReader(journalConfig{Format: "json", Args: []string{"--cursor=c0"}}, nil)
+	AssertNotError(t, err)
+	defer reader.Close()
+
+	for _, expected := range []string{"one", "two", "three"} {
+		entry, err := reader.Next()
+		AssertNotError(t, err)
+		AssertEquals(t, expected, entry.Message)
+	}
+
+	_, err = reader.Next()
+	AssertEquals(t, io.EOF, err)
+
+	AssertEquals(t, failures+1, metrics.parseFailures.Get())
+	AssertEquals(t, restarts+1, metrics.journalctlRestarts.Get())
+
+	args, err := ioutil.ReadFile(argsFile)
+	AssertNotError(t, err)
+	AssertEquals(t, "--all --output=json --cursor=c0\n--all --output=json --after-cursor=c2\n", string(args))
+}
+
+func TestJournalctlNotRestartedAfterClose(t *testing.T) {
+	_, cleanup := fakeJournalctl(t, `echo '{"__CURSOR":"c1","MESSAGE":"one"}'; exec sleep 10`)
+	defer cleanup()
+
+	reader, err := newJournalctlReader(journalConfig{Format: "json", Follow: true}, nil)
+	AssertNotError(t, err)
+
+	entry, err := reader.Next()
+	AssertNotError(t, err)
+	AssertEquals(t, "one", entry.Message)
+
+	AssertNotError(t, reader.Close())
+
+	_, err = reader.Next()
+	AssertEquals(t, io.EOF, err)
+}
+
+// Returns its entries, then err or io.EOF
+type scriptedReader struct {
+	entries []SystemdJournalEntry
+	err     error
+	closed  bool
+}
+
+func (this *scriptedReader) Next() (SystemdJournalEntry, error) {
+	if len(this.entries) > 0 {
+		entry := this.entries[0]
+		this.entries = this.entries[1:]
+		return entry, nil
+	}
+
+	if this.err != nil {
+		return SystemdJournalEntry{}, this.err
+	}
+
+	return SystemdJournalEntry{}, io.EOF
+}
+
+func (this *scriptedReader) Close() error {
+	this.closed = true
+	return nil
+}
+
+func TestFailedInputReopenedAfterLastEntry(t *testing.T) {
+	failing := &scriptedReader{entries: []SystemdJournalEntry{{Cursor: "c1"}}, err: errors.New("connection lost")}
+	next := &scriptedReader{entries: []SystemdJournalEntry{{Cursor: "c2"}}}
+
+	var resumed string
+	reader := &supervisedReader{
+		input:  "remote",
+		reader: failing,
+		open: func(cursor *cursorState) (journalReader, error) {
+			resumed = cursor.Get()
+			return next, nil
+		},
+		delay:  time.Millisecond,
+		closed: make(chan struct{}),
+	}
+	reopens := metrics.inputReopens.Get()
+
+	for _, expected := range []string{"c1", "c2"} {
+		entry, err := reader.Next()
+		AssertNotError(t, err)
+		AssertEquals(t, expected, entry.Cursor)
+	}
+
+	_, err := reader.Next()
+	AssertEquals(t, io.EOF, err)
+	AssertEquals(t, "c1", resumed)
+	AssertEquals(t, true, failing.closed)
+	AssertEquals(t, reopens+1, metrics.inputReopens.Get())
+}
+
+func TestClosingStopsReopening(t *testing.T) {
+	reader := &supervisedReader{
+		input:  "remote",
+		reader: &scriptedReader{err: errors.New("connection lost")},
+		open: func(cursor *cursorState) (journalReader, error) {
+			return nil, errors.New("address in use")
+		},
+		delay:  time.Millisecond,
+		closed: make(chan struct{}),
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		reader.Close()
+	}()
+
+	_, err := reader.Next()
+	AssertEquals(t, io.EOF, err)
+}
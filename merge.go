@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// When enabled, lines matching one of the patterns are appended to the previous entry from the
+// same process, when it was logged within timing.samesource_time_difference. Entries without a
+// _PID are never merged, since nothing tells whether they come from the same process
+type multilineConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Patterns []string `json:"patterns"`
+	MaxLines int      `json:"max_lines"`
+	MaxBytes int      `json:"max_bytes"`
+
+	patterns []*regexp.Regexp
+}
+
+var defaultContinuationPatterns = []string{
+	`^[ \t]+\S`,
+	`^Caused by: `,
+	`^Traceback \(most recent call last\):`,
+	`^\.\.\. \d+ (more|common frames omitted)`,
+	`^[\w$.]+(Error|Exception)(: |$)`,
+}
+
+func (this *multilineConfig) compile() error {
+	this.patterns = nil
+
+	for i, pattern := range this.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("multiline.patterns[%d]: %s", i, err)
+		}
+
+		this.patterns = append(this.patterns, re)
+	}
+
+	if this.MaxLines < 1 {
+		return fmt.Errorf("multiline.max_lines: must be at least 1")
+	}
+
+	if this.MaxBytes < 1 {
+		return fmt.Errorf("multiline.max_bytes: must be at least 1")
+	}
+
+	return nil
+}
+
+func (this *multilineConfig) continuation(message string) bool {
+	for _, re := range this.patterns {
+		if re.MatchString(message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether next continues the pending message. Must be called with the lock held
+func (this *pendingEntry) continuedBy(next *SystemdJournalEntry) bool {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	multiline := &config.Multiline
+
+	return multiline.Enabled &&
+		next.Pid != "" &&
+		this.entry.Pid == next.Pid &&
+		this.entry.Systemd_unit == next.Systemd_unit &&
+		this.entry.Hostname == next.Hostname &&
+		next.Realtime_timestamp-this.last <= config.Timing.SameSourceTimeDifference.Microseconds() &&
+		this.lines < multiline.MaxLines &&
+		len(this.entry.Message)+1+len(next.Message) <= multiline.MaxBytes &&
+		multiline.continuation(next.Message)
+}
+
+// Appends the message of next and moves the position in the journal past it. Must be called with the lock held
+func (this *pendingEntry) merge(next *SystemdJournalEntry) {
+	this.entry.Message += "\n" + next.Message
+	this.entry.Cursor = next.Cursor
+	this.last = next.Realtime_timestamp
+	this.lines++
+
+	if this.lines == 2 {
+		metrics.multilineGroups.Inc()
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func stackTraceEntries(t *testing.T, lines ...string) []SystemdJournalEntry {
+	var entries []SystemdJournalEntry
+
+	for i, line := range lines {
+		var entry SystemdJournalEntry
+
+		data, _ := json.Marshal(map[string]string{
+			"__CURSOR":             "s=abc;i=" + strconv.Itoa(i),
+			"__REALTIME_TIMESTAMP": strconv.FormatInt(1549067421724300+int64(i)*1000, 10),
+			"MESSAGE":              line,
+			"_PID":                 "1234",
+			"_SYSTEMD_UNIT":        "app.service",
+		})
+		AssertNotError(t, json.Unmarshal(data, &entry))
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestContinuationLinesMerged(t *testing.T) {
+	entries := stackTraceEntries(t,
+		"Exception in thread \"main\" java.lang.IllegalStateException: boom",
+		"\tat com.example.Main.main(Main.java:10)",
+		"Caused by: java.io.IOException: disk full",
+		"\t... 3 more",
+		"next message",
+	)
+
+	defer func(saved Config) { config = saved }(config)
+	config.Multiline.Enabled = true
+
+	var pending pendingEntry
+	pending.Push(entries[0])
+
+	for _, entry := range entries[1:4] {
+		AssertEquals(t, true, pending.continuedBy(&entry))
+		pending.merge(&entry)
+	}
+
+	AssertEquals(t, false, pending.continuedBy(&entries[4]))
+	AssertEquals(t, 4, pending.lines)
+	AssertEquals(t, "s=abc;i=3", pending.entry.Cursor)
+
+	gelf := pending.entry.toGelf()
+	AssertEquals(t, "Exception in thread \"main\" java.lang.IllegalStateException: boom", gelf.Short)
+	AssertEquals(t, "Exception in thread \"main\" java.lang.IllegalStateException: boom\n\tat com.example.Main.main(Main.java:10)\nCaused by: java.io.IOException: disk full\n\t... 3 more", gelf.Full)
+	AssertEquals(t, float64(1549067421.7243001), gelf.TimeUnix)
+}
+
+func TestMergeRespectsSourceWindowAndLimits(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Multiline.Enabled = true
+	config.Multiline.MaxLines = 2
+
+	entries := stackTraceEntries(t, "Traceback (most recent call last):", "  File \"x.py\", line 1", "  File \"y.py\", line 2")
+
+	var pending pendingEntry
+	pending.Push(entries[0])
+
+	other := entries[1]
+	other.Pid = "999"
+	AssertEquals(t, false, pending.continuedBy(&other))
+
+	unknown := entries[1]
+	unknown.Pid = ""
+	pending.entry.Pid = ""
+	AssertEquals(t, false, pending.continuedBy(&unknown))
+	pending.entry.Pid = entries[0].Pid
+
+	late := entries[1]
+	late.Realtime_timestamp += 1000 * 1000
+	AssertEquals(t, false, pending.continuedBy(&late))
+
+	AssertEquals(t, true, pending.continuedBy(&entries[1]))
+	pending.merge(&entries[1])
+	AssertEquals(t, false, pending.continuedBy(&entries[2]))
+}
+
+func TestMergingDisabledByDefault(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config = defaultConfig()
+
+	entries := stackTraceEntries(t, "Traceback (most recent call last):", "  File \"x.py\", line 1")
+
+	var pending pendingEntry
+	pending.Push(entries[0])
+
+	AssertEquals(t, false, pending.continuedBy(&entries[1]))
+}
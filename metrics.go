@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const METRICS_PREFIX = "systemdjournal2gelf_"
+
+type counter struct {
+	value uint64
+}
+
+func (this *counter) Add(n uint64) {
+	atomic.AddUint64(&this.value, n)
+}
+
+func (this *counter) Inc() {
+	this.Add(1)
+}
+
+func (this *counter) Get() uint64 {
+	return atomic.LoadUint64(&this.value)
+}
+
+// Counters by the value of a single label
+type counterVec struct {
+	sync.Mutex
+	label  string
+	values map[string]*counter
+}
+
+func newCounterVec(label string) *counterVec {
+	return &counterVec{label: label, values: make(map[string]*counter)}
+}
+
+func (this *counterVec) With(value string) *counter {
+	this.Lock()
+	defer this.Unlock()
+
+	c, ok := this.values[value]
+	if !ok {
+		c = &counter{}
+		this.values[value] = c
+	}
+
+	return c
+}
+
+func (this *counterVec) write(w io.Writer, name string) {
+	this.Lock()
+	defer this.Unlock()
+
+	var values []string
+	for value := range this.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for _, value := range values {
+		fmt.Fprintf(w, "%s%s{%s=%q} %d\n", METRICS_PREFIX, name, this.label, value, this.values[value].Get())
+	}
+}
+
+var metrics = struct {
+	entriesRead          counter
+	entriesSent          counter
+	sendErrors           counter
+	parseFailures        counter
+	multilineGroups      counter
+	journalctlRestarts   counter
+	inputReopens         counter
+	udpChunks            counter
+	duplicatesSuppressed counter
+	bytesSent            *counterVec
+	entriesDropped       *counterVec
+	entriesRateLimited   *counterVec
+	redactions           *counterVec
+	messagesRejected     *counterVec
+	// __REALTIME_TIMESTAMP of the last sent entry, in microseconds
+	lastSentTimestamp int64
+}{
+	bytesSent:          newCounterVec("transport"),
+	entriesDropped:     newCounterVec("filter"),
+	entriesRateLimited: newCounterVec("limit"),
+	redactions:         newCounterVec("rule"),
+	messagesRejected:   newCounterVec("output"),
+}
+
+// realtime is the __REALTIME_TIMESTAMP of the entry, in microseconds
+func recordSent(realtime int64) {
+	metrics.entriesSent.Inc()
+	if realtime > 0 {
+		atomic.StoreInt64(&metrics.lastSentTimestamp, realtime)
+	}
+}
+
+// Writes all metrics in the Prometheus text format
+func writeMetrics(w io.Writer) {
+	writeMetric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", METRICS_PREFIX, name, help, METRICS_PREFIX, name, kind)
+		if value != nil {
+			fmt.Fprintf(w, "%s%s %v\n", METRICS_PREFIX, name, value)
+		}
+	}
+
+	writeMetric("entries_read_total", "counter", "Entries read from the journal.", metrics.entriesRead.Get())
+	writeMetric("entries_sent_total", "counter", "Messages written to Graylog.", metrics.entriesSent.Get())
+	writeMetric("send_errors_total", "counter", "Failed attempts to write a message to Graylog.", metrics.sendErrors.Get())
+	writeMetric("parse_failures_total", "counter", "Journal entries that could not be decoded.", metrics.parseFailures.Get())
+	writeMetric("multiline_groups_total", "counter", "Messages that were merged from multiple journal entries.", metrics.multilineGroups.Get())
+	writeMetric("journalctl_restarts_total", "counter", "Times journalctl was restarted after it exited.", metrics.journalctlRestarts.Get())
+	writeMetric("input_reopens_total", "counter", "Times the journal input was opened again after it failed.", metrics.inputReopens.Get())
+	writeMetric("duplicates_suppressed_total", "counter", "Repeated messages that were only counted.", metrics.duplicatesSuppressed.Get())
+	writeMetric("udp_chunks_total", "counter", "Datagrams sent as part of a chunked GELF message.", metrics.udpChunks.Get())
+
+	writeMetric("bytes_sent_total", "counter", "Bytes written to Graylog, after compression except for udp.", nil)
+	metrics.bytesSent.write(w, "bytes_sent_total")
+
+	writeMetric("entries_dropped_total", "counter", "Entries dropped by a filter.", nil)
+	metrics.entriesDropped.write(w, "entries_dropped_total")
+
+	writeMetric("entries_rate_limited_total", "counter", "Entries suppressed by a rate limit.", nil)
+	metrics.entriesRateLimited.write(w, "entries_rate_limited_total")
+
+	writeMetric("redactions_total", "counter", "Values replaced by a redaction rule.", nil)
+	metrics.redactions.write(w, "redactions_total")
+
+	writeMetric("messages_rejected_total", "counter", "Messages dropped because the output rejected them.", nil)
+	metrics.messagesRejected.write(w, "messages_rejected_total")
+
+	writeMetric("queue_depth", "gauge", "Entries waiting in the spool or queue of an output.", nil)
+	for _, output := range sortedOutputs() {
+		fmt.Fprintf(w, "%squeue_depth{output=%q} %d\n", METRICS_PREFIX, output.name, output.spool.Depth()+len(output.queue))
+	}
+
+	lag := 0.0
+	if last := atomic.LoadInt64(&metrics.lastSentTimestamp); last > 0 {
+		lag = float64(time.Now().UnixNano()/1000-last) / 1000 / 1000
+	}
+	writeMetric("cursor_lag_seconds", "gauge", "Time between now and the __REALTIME_TIMESTAMP of the last sent entry.", lag)
+}
+
+func serveMetrics(listen string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		panic("while serving metrics: " + err.Error())
+	}
+}
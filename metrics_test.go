@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCounterVecWritesSortedLabels(t *testing.T) {
+	v := newCounterVec("transport")
+	v.With("udp").Add(10)
+	v.With("tcp").Inc()
+	v.With("udp").Add(5)
+
+	var buf bytes.Buffer
+	v.write(&buf, "bytes_sent_total")
+
+	AssertEquals(t, "systemdjournal2gelf_bytes_sent_total{transport=\"tcp\"} 1\n"+
+		"systemdjournal2gelf_bytes_sent_total{transport=\"udp\"} 15\n", buf.String())
+}
+
+func TestCursorLagUsesJournalTimestamp(t *testing.T) {
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": {}})()
+
+	entry := SystemdJournalEntry{Cursor: "c1", Realtime_timestamp: 1549067421724300, Event_timestamp: 1000000}
+	entry.sendMessage(entry.toGelf())
+
+	AssertEquals(t, int64(1549067421724300), atomic.LoadInt64(&metrics.lastSentTimestamp))
+}
+
+func TestWriteMetricsIncludesCountersAndGauges(t *testing.T) {
+	before := metrics.entriesSent.Get()
+	recordSent(1500000000500000)
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	out := buf.String()
+
+	for _, expected := range []string{
+		"# TYPE systemdjournal2gelf_entries_read_total counter\n",
+		"# TYPE systemdjournal2gelf_bytes_sent_total counter\n",
+		"# TYPE systemdjournal2gelf_queue_depth gauge\n",
+		"# TYPE systemdjournal2gelf_cursor_lag_seconds gauge\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in output:\n%s", expected, out)
+		}
+	}
+
+	AssertEquals(t, before+1, metrics.entriesSent.Get())
+	AssertEquals(t, int64(1500000000500000), metrics.lastSentTimestamp)
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A named Graylog destination. The top-level destination, tls, http and spool form the output named "default"
+type outputConfig struct {
+	Destination string      `json:"destination"`
+	TLS         tlsOptions  `json:"tls"`
+	HTTP        httpOptions `json:"http"`
+	Spool       spoolConfig `json:"spool"`
+}
+
+// Entries of which every field in Match has a value matching one of its patterns, and which pass When
+// when set, are sent to Outputs. Patterns may contain * and ?, fields that are missing never match. Routes are tried in order and
+// only the first matching one is used, unless Continue is set. Mode "copy" sends to every output,
+// "failover" only to the first one that is healthy
+type routeConfig struct {
+	Match    map[string][]string `json:"match"`
+	Outputs  []string            `json:"outputs"`
+	Mode     string              `json:"mode"`
+	Continue bool                `json:"continue"`
+	When     *conditionConfig    `json:"when"`
+
+	match map[string]*regexp.Regexp
+}
+
+const DEFAULT_OUTPUT = "default"
+
+// Outputs in a config file get the same spool and http defaults as the top-level ones
+func (this *outputConfig) UnmarshalJSON(data []byte) error {
+	type plain outputConfig
+	output := plain{Spool: defaultConfig().Spool, HTTP: defaultHTTPOptions}
+
+	if err := json.Unmarshal(data, &output); err != nil {
+		return err
+	}
+
+	*this = outputConfig(output)
+
+	return nil
+}
+
+func (this *outputConfig) validate(key string) error {
+	if this.Destination == "" {
+		return fmt.Errorf("%s: is required", joinKey(key, "destination"))
+	}
+
+	if i := strings.Index(this.Destination, "://"); i >= 0 {
+		switch this.Destination[:i] {
+		case "udp", "tcp", "tls", "http", "https":
+		default:
+			return fmt.Errorf("%s: unsupported scheme %q, use udp://, tcp://, tls://, http:// or https://", joinKey(key, "destination"), this.Destination[:i])
+		}
+	}
+
+	if err := this.HTTP.validate(key); err != nil {
+		return err
+	}
+
+	if (this.TLS.Cert == "") != (this.TLS.Key == "") {
+		return fmt.Errorf("%s: %s and %s must be used together", joinKey(key, "tls.cert"), joinKey(key, "tls.cert"), joinKey(key, "tls.key"))
+	}
+
+	if this.Spool.MaxSize < 0 {
+		return fmt.Errorf("%s: must not be negative", joinKey(key, "spool.max_size"))
+	}
+
+	if this.Spool.MaxAge.Duration < 0 {
+		return fmt.Errorf("%s: must not be negative", joinKey(key, "spool.max_age"))
+	}
+
+	return nil
+}
+
+// The configured outputs, or the output named "default" made from the top-level settings
+func (this *Config) outputConfigs() map[string]outputConfig {
+	if len(this.Outputs) == 0 {
+		return map[string]outputConfig{DEFAULT_OUTPUT: {Destination: this.Destination, TLS: this.TLS, HTTP: this.HTTP, Spool: this.Spool}}
+	}
+
+	return this.Outputs
+}
+
+// Checks the outputs and routes, adding a route to every output when there are none
+func (this *Config) validateOutputs() error {
+	if len(this.Outputs) > 0 && (this.Destination != "" || this.TLS != (tlsOptions{}) || this.HTTP != defaultHTTPOptions || this.Spool.Dir != "") {
+		return errors.New("destination: cannot be combined with outputs, add it as an output instead")
+	}
+
+	var names []string
+	spoolDirs := make(map[string]string)
+	for name, output := range this.outputConfigs() {
+		key := "outputs." + name
+		if len(this.Outputs) == 0 {
+			key = ""
+		} else if name == "" {
+			return errors.New("outputs: names must not be empty")
+		}
+
+		if err := output.validate(key); err != nil {
+			return err
+		}
+
+		if other, ok := spoolDirs[output.Spool.Dir]; ok && output.Spool.Dir != "" {
+			return fmt.Errorf("%s.spool.dir: already used by output %s", key, other)
+		}
+		spoolDirs[output.Spool.Dir] = name
+
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(this.Routes) == 0 {
+		this.Routes = []routeConfig{{Outputs: names}}
+	}
+
+	for i := range this.Routes {
+		if err := this.Routes[i].validate(fmt.Sprintf("routes[%d]", i), this.outputConfigs()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *routeConfig) validate(key string, outputs map[string]outputConfig) error {
+	if len(this.Outputs) == 0 {
+		return fmt.Errorf("%s.outputs: at least one output is required", key)
+	}
+
+	for i, name := range this.Outputs {
+		if _, ok := outputs[name]; !ok {
+			return fmt.Errorf("%s.outputs[%d]: unknown output %q", key, i, name)
+		}
+	}
+
+	switch this.Mode {
+	case "":
+		this.Mode = "copy"
+	case "copy", "failover":
+	default:
+		return fmt.Errorf("%s.mode: unknown mode %q, use copy or failover", key, this.Mode)
+	}
+
+	this.match = make(map[string]*regexp.Regexp, len(this.Match))
+	for field, patterns := range this.Match {
+		if len(patterns) == 0 {
+			return fmt.Errorf("%s.match.%s: at least one pattern is required", key, field)
+		}
+
+		this.match[field] = globRegexp(patterns)
+	}
+
+	if this.When != nil {
+		return this.When.compile(key + ".when")
+	}
+
+	return nil
+}
+
+// Matches values against shell-like patterns, unlike path.Match a * also matches a /
+func globRegexp(patterns []string) *regexp.Regexp {
+	var alternatives []string
+	for _, pattern := range patterns {
+		quoted := regexp.QuoteMeta(pattern)
+		quoted = strings.Replace(quoted, `\*`, `.*`, -1)
+		quoted = strings.Replace(quoted, `\?`, `.`, -1)
+		alternatives = append(alternatives, quoted)
+	}
+
+	return regexp.MustCompile(`^(?s:` + strings.Join(alternatives, "|") + `)$`)
+}
+
+func (this *routeConfig) matches(entry *SystemdJournalEntry) bool {
+	for field, pattern := range this.match {
+		value, ok := entry.Fields[field]
+		if !ok || !pattern.MatchString(value) {
+			return false
+		}
+	}
+
+	return this.When == nil || this.When.matches(entry.Fields)
+}
+
+// Sends to the outputs of the route, except for those in sent. The outputs that took the entry are
+// added to sent, a failover route is skipped when one of its outputs already has it
+func (this *routeConfig) deliver(entry *trackedEntry, message *gelf.Message, sent map[string]bool) {
+	var targets []*output
+	for _, name := range this.Outputs {
+		if !sent[name] {
+			targets = append(targets, outputs[name])
+		} else if this.Mode == "failover" {
+			return
+		}
+	}
+
+	if this.Mode == "failover" {
+		if output := failover(targets, entry, message); output != nil {
+			sent[output.name] = true
+		}
+		return
+	}
+
+	for _, output := range targets {
+		output.deliver(entry, message)
+		sent[output.name] = true
+	}
+}
+
+// Sends to the first output that's healthy, which means its last write succeeded or failed longer
+// than timing.sleep_after_error ago, and returns it. An output with a spool or workers is trusted
+// to deliver eventually, others are written to right away to find out whether they are healthy
+func failover(targets []*output, entry *trackedEntry, message *gelf.Message) *output {
+	for len(targets) > 0 {
+		for _, output := range targets {
+			if output.healthy() && output.tryDeliver(entry, message) {
+				return output
+			}
+		}
+
+		configLock.RLock()
+		sleepAfterError := config.Timing.SleepAfterError.Duration
+		configLock.RUnlock()
+
+		select {
+		case <-time.After(sleepAfterError):
+		case <-shutdownDeadline.Done():
+			// never done, so the cursor stays before the entry
+			acks.add(entry)
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// An opened outputConfig, its writer is replaced on SIGHUP while holding configLock
+type output struct {
+	// UnixNano of the last failed write, 0 after a successful one. First for 64-bit alignment of atomics
+	failed int64
+	name   string
+	writer gelf.Writer
+	spool  *diskSpool
+	// messages for the workers, when they are sent in the background, see sender.go
+	queue chan outbound
+}
+
+// Opened at startup, the set of outputs doesn't change while running
+var outputs map[string]*output
+
+func openOutputs(configs map[string]outputConfig) (map[string]*output, error) {
+	opened := make(map[string]*output, len(configs))
+
+	for name, config := range configs {
+		w, err := newWriter(config.Destination, config.TLS, config.HTTP)
+		if err != nil {
+			closeOutputs(opened)
+			return nil, fmt.Errorf("output %s: %s", name, err)
+		}
+
+		output := &output{name: name, writer: w}
+		opened[name] = output
+
+		if config.Spool.Dir != "" {
+			output.spool, err = newDiskSpool(config.Spool.Dir, config.Spool.MaxSize*1024*1024, config.Spool.MaxAge.Duration)
+			if err != nil {
+				closeOutputs(opened)
+				return nil, fmt.Errorf("output %s: while opening spool: %s", name, err)
+			}
+		}
+	}
+
+	return opened, nil
+}
+
+func closeOutputs(outputs map[string]*output) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	for _, output := range outputs {
+		output.writer.Close()
+	}
+}
+
+// Sorted by name, for predictable logging and metrics
+func sortedOutputs() []*output {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	var sorted []*output
+	for _, output := range outputs {
+		sorted = append(sorted, output)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	return sorted
+}
+
+// Appends to the spool when there is one, otherwise queues it for the workers or writes until it succeeds
+func (this *output) deliver(entry *trackedEntry, message *gelf.Message) {
+	if this.spool != nil {
+		err := this.spool.Append(entry.cursor, entry.realtime, message)
+		if err == nil {
+			// the spool is synced to disk before the cursor is saved, see flushState
+			return
+		}
+
+		fmt.Fprintf(os.Stderr, "spool - sending directly to output %s because of: %s\n", this.name, err)
+	}
+
+	// a delivery that was given up on is never done, so the cursor stays before the entry
+	queued := outbound{message: message, realtime: entry.realtime, entry: entry}
+	if this.queue != nil {
+		acks.add(entry)
+		select {
+		case this.queue <- queued:
+		case <-shutdownDeadline.Done():
+		}
+		return
+	}
+
+	if !this.writeMessages([]outbound{queued}) {
+		acks.add(entry)
+	}
+}
+
+// Like deliver, but an output without a spool or workers only gets a single attempt. Returns whether
+// the output took the message
+func (this *output) tryDeliver(entry *trackedEntry, message *gelf.Message) bool {
+	if this.spool != nil || this.queue != nil {
+		this.deliver(entry, message)
+		return true
+	}
+
+	err := this.write(outbound{message: message, realtime: entry.realtime, entry: entry})
+
+	return err == nil || this.dropRejected(err)
+}
+
+// A single attempt, which marks the output as unhealthy when it fails
+func (this *output) write(message outbound) error {
+	_, err := this.writeBatch([]outbound{message})
+	return err
+}
+
+// A single attempt at writing the messages, in one go when the writer is a batchWriter. Returns how
+// many were sent before an error
+func (this *output) writeBatch(batch []outbound) (int, error) {
+	configLock.RLock()
+	w := this.writer
+	configLock.RUnlock()
+
+	messages := make([]*gelf.Message, len(batch))
+	for i, queued := range batch {
+		messages[i] = queued.message
+	}
+
+	var n int
+	var err error
+	if bw, ok := w.(batchWriter); ok {
+		n, err = bw.WriteMessages(messages)
+	} else {
+		for n < len(messages) {
+			if err = w.WriteMessage(messages[n]); err != nil {
+				break
+			}
+			n++
+		}
+	}
+
+	for _, sent := range batch[:n] {
+		recordSent(sent.realtime)
+	}
+
+	if _, rejected := err.(rejectedError); err != nil && !rejected {
+		atomic.StoreInt64(&this.failed, time.Now().UnixNano())
+	}
+
+	if err != nil {
+		metrics.sendErrors.Inc()
+		fmt.Fprintf(os.Stderr, "send - output %s failed because of: %s\n", this.name, err)
+
+		return n, err
+	}
+
+	atomic.StoreInt64(&this.failed, 0)
+
+	return n, nil
+}
+
+// Reports whether the output rejected the message that failed, which is dropped instead of retried
+func (this *output) dropRejected(err error) bool {
+	if _, rejected := err.(rejectedError); !rejected {
+		return false
+	}
+
+	metrics.messagesRejected.With(this.name).Inc()
+	fmt.Fprintf(os.Stderr, "send - output %s rejected a message, dropping it\n", this.name)
+
+	return true
+}
+
+func (this *output) healthy() bool {
+	failed := atomic.LoadInt64(&this.failed)
+	if failed == 0 {
+		return true
+	}
+
+	configLock.RLock()
+	sleepAfterError := config.Timing.SleepAfterError.Duration
+	configLock.RUnlock()
+
+	return time.Since(time.Unix(0, failed)) >= sleepAfterError
+}
+
+// Writes until every message is sent, without sending those that were sent already again. Returns
+// false when it gave up because the shutdown timeout passed
+func (this *output) writeMessages(batch []outbound) bool {
+	for len(batch) > 0 {
+		n, err := this.writeBatch(batch)
+		batch = batch[n:]
+		if err == nil {
+			continue
+		} else if this.dropRejected(err) {
+			batch = batch[1:]
+			continue
+		}
+
+		//	UDP is nonblocking, but the OS stores an error which go will return on the next call.
+		//	This means we've already lost a message, but can keep retrying the current one. Sleep to make this less obtrusive
+		// the lock isn't held while sleeping, so a reload can replace a failing writer
+		configLock.RLock()
+		sleepAfterError := config.Timing.SleepAfterError.Duration
+		configLock.RUnlock()
+
+		select {
+		case <-time.After(sleepAfterError):
+		case <-shutdownDeadline.Done():
+			return false
+		}
+	}
+
+	return true
+}
+
+// Sends records from the spool in batches of up to sender.batch_size
+func (this *output) drainSpool() {
+	for {
+		configLock.RLock()
+		batchSize := config.Sender.BatchSize
+		configLock.RUnlock()
+
+		records := this.spool.NextBatch(batchSize)
+
+		batch := make([]outbound, len(records))
+		for i, record := range records {
+			batch[i] = outbound{message: record.Message, realtime: record.Realtime}
+		}
+
+		if !this.writeMessages(batch) {
+			return
+		}
+		this.spool.Ack()
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Keeps written messages, or fails every write when err is set
+type recordingWriter struct {
+	sync.Mutex
+	messages []*gelf.Message
+	err      error
+	closed   bool
+}
+
+func (this *recordingWriter) WriteMessage(m *gelf.Message) error {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.err != nil {
+		return this.err
+	}
+
+	this.messages = append(this.messages, m)
+
+	return nil
+}
+
+func (this *recordingWriter) Write(p []byte) (int, error) {
+	return len(p), this.WriteMessage(&gelf.Message{Short: string(p)})
+}
+
+func (this *recordingWriter) Close() error {
+	this.Lock()
+	defer this.Unlock()
+
+	this.closed = true
+
+	return nil
+}
+
+// Replaces the outputs with writers that record messages, routes default to copying to all of them
+func useOutputs(t *testing.T, routes []routeConfig, writers map[string]*recordingWriter) func() {
+	savedConfig, savedOutputs := config, outputs
+
+	config = defaultConfig()
+	config.Outputs = make(map[string]outputConfig)
+	config.Routes = routes
+	outputs = make(map[string]*output)
+
+	for name, w := range writers {
+		config.Outputs[name] = outputConfig{Destination: "udp://localhost:12201"}
+		outputs[name] = &output{name: name, writer: w}
+	}
+
+	AssertNotError(t, config.validateOutputs())
+
+	return func() {
+		// sends that were abandoned by a test may still be running
+		configLock.Lock()
+		defer configLock.Unlock()
+
+		config, outputs = savedConfig, savedOutputs
+	}
+}
+
+func TestRoutesSelectOutputs(t *testing.T) {
+	security, apps := &recordingWriter{}, &recordingWriter{}
+	defer useOutputs(t, []routeConfig{
+		{Match: map[string][]string{"_SYSTEMD_UNIT": {"sshd.service", "sudo*"}}, Outputs: []string{"security"}, Continue: true},
+		{Match: map[string][]string{"_TRANSPORT": {"audit"}}, Outputs: []string{"security"}},
+		{Outputs: []string{"apps"}},
+	}, map[string]*recordingWriter{"security": security, "apps": apps})()
+
+	for _, fields := range []map[string]string{
+		{"MESSAGE": "login", "_SYSTEMD_UNIT": "sshd.service"},
+		{"MESSAGE": "audit", "_TRANSPORT": "audit"},
+		{"MESSAGE": "request", "_SYSTEMD_UNIT": "api/v1.service"},
+	} {
+		var entry SystemdJournalEntry
+		AssertNotError(t, entry.setFields(fields))
+		entry.send()
+	}
+
+	AssertEquals(t, 2, len(security.messages))
+	AssertEquals(t, "login", security.messages[0].Short)
+	AssertEquals(t, "audit", security.messages[1].Short)
+
+	// continued after the first route, but the last route doesn't get the audit entry
+	AssertEquals(t, 2, len(apps.messages))
+	AssertEquals(t, "login", apps.messages[0].Short)
+	AssertEquals(t, "request", apps.messages[1].Short)
+}
+
+func TestFailoverUsesFirstHealthyOutput(t *testing.T) {
+	primary, secondary := &recordingWriter{err: errors.New("unreachable")}, &recordingWriter{}
+	defer useOutputs(t, []routeConfig{
+		{Outputs: []string{"primary", "secondary"}, Mode: "failover"},
+	}, map[string]*recordingWriter{"primary": primary, "secondary": secondary})()
+	config.Timing.SleepAfterError.Duration = time.Hour
+
+	(&SystemdJournalEntry{Message: "one"}).send()
+	AssertEquals(t, 1, len(secondary.messages))
+	AssertEquals(t, false, outputs["primary"].healthy())
+
+	// the failed output isn't tried again until sleep_after_error passed
+	primary.err = nil
+	(&SystemdJournalEntry{Message: "two"}).send()
+	AssertEquals(t, 0, len(primary.messages))
+	AssertEquals(t, 2, len(secondary.messages))
+
+	config.Timing.SleepAfterError.Duration = 0
+	(&SystemdJournalEntry{Message: "three"}).send()
+	AssertEquals(t, 1, len(primary.messages))
+}
+
+func TestFailoverLeavesOtherOutputsToLaterRoutes(t *testing.T) {
+	primary, secondary := &recordingWriter{}, &recordingWriter{}
+	defer useOutputs(t, []routeConfig{
+		{Outputs: []string{"primary", "secondary"}, Mode: "failover", Continue: true},
+		{Outputs: []string{"secondary"}, Continue: true},
+		{Outputs: []string{"primary", "secondary"}, Mode: "failover"},
+	}, map[string]*recordingWriter{"primary": primary, "secondary": secondary})()
+
+	(&SystemdJournalEntry{Message: "one"}).send()
+	AssertEquals(t, 1, len(primary.messages))
+	AssertEquals(t, 1, len(secondary.messages))
+}
+
+func TestFailoverQueuesForWorkers(t *testing.T) {
+	defer useCursor()()
+
+	primary, secondary := &recordingWriter{err: errors.New("unreachable")}, &recordingWriter{}
+	defer useOutputs(t, []routeConfig{
+		{Outputs: []string{"primary", "secondary"}, Mode: "failover"},
+	}, map[string]*recordingWriter{"primary": primary, "secondary": secondary})()
+	config.Timing.SleepAfterError.Duration = time.Hour
+
+	// the primary failed recently, so the entry is queued for the worker of the secondary
+	atomic.StoreInt64(&outputs["primary"].failed, time.Now().UnixNano())
+
+	output := outputs["secondary"]
+	output.startSender(senderConfig{Workers: 1, MaxInFlight: 10, BatchSize: 10})
+	defer close(output.queue)
+
+	(&SystemdJournalEntry{Cursor: "s=1", Message: "one"}).send()
+	acks.WaitEmpty(nil)
+
+	AssertEquals(t, 1, len(secondary.messages))
+	AssertEquals(t, "s=1", cursor.Get())
+}
+
+func TestOutputsConfig(t *testing.T) {
+	config, err := loadConfigString(t, `{
+		"outputs": {
+			"security": {"destination": "tls://security:12201", "spool": {"dir": "/var/spool/security"}},
+			"apps": {"destination": "udp://apps:12201"}
+		},
+		"routes": [{"match": {"PRIORITY": ["[0-3]"]}, "outputs": ["security", "apps"]}]
+	}`)
+	AssertNotError(t, err)
+	AssertEquals(t, int64(1024), config.Outputs["security"].Spool.MaxSize)
+	AssertEquals(t, "copy", config.Routes[0].Mode)
+
+	config, err = loadConfigString(t, `{"destination": "graylog:12201"}`)
+	AssertNotError(t, err)
+	AssertEquals(t, "graylog:12201", config.outputConfigs()["default"].Destination)
+	AssertEquals(t, "default", config.Routes[0].Outputs[0])
+
+	for data, expected := range map[string]string{
+		`{"destination": "a:1", "outputs": {"b": {"destination": "b:1"}}}`:                          "destination: cannot be combined with outputs",
+		`{"outputs": {"b": {"destination": "b:1"}}, "routes": [{"outputs": ["c"]}]}`:                "routes[0].outputs[0]: unknown output",
+		`{"outputs": {"b": {"destination": "b:1"}}, "routes": [{"outputs": ["b"], "mode": "all"}]}`: "routes[0].mode: unknown mode",
+		`{"outputs": {"b": {"destination": "smtp://b:1"}}}`:                                         "outputs.b.destination: unsupported scheme",
+	} {
+		_, err := loadConfigString(t, data)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %s, got %v", expected, data, err)
+		}
+	}
+}
+
+func TestRouteWhenCondition(t *testing.T) {
+	alerts, rest := &recordingWriter{}, &recordingWriter{}
+	lte := 3.0
+	defer useOutputs(t, []routeConfig{
+		{When: &conditionConfig{Field: "PRIORITY", Lte: &lte}, Outputs: []string{"alerts"}},
+		{Outputs: []string{"rest"}},
+	}, map[string]*recordingWriter{"alerts": alerts, "rest": rest})()
+
+	for _, priority := range []string{"2", "6"} {
+		var entry SystemdJournalEntry
+		AssertNotError(t, entry.setFields(map[string]string{"PRIORITY": priority, "MESSAGE": priority}))
+		entry.send()
+	}
+
+	AssertEquals(t, 1, len(alerts.messages))
+	AssertEquals(t, "2", alerts.messages[0].Short)
+	AssertEquals(t, 1, len(rest.messages))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Decodes messages of the selected units or identifiers as a json object or logfmt pairs.
+// The first key found in each of the *Keys lists is used for that part of the GELF message,
+// any other key becomes an additional field
+type payloadConfig struct {
+	unitSelector
+	Format          string   `json:"format"`
+	MessageKeys     []string `json:"message_keys"`
+	FullMessageKeys []string `json:"full_message_keys"`
+	LevelKeys       []string `json:"level_keys"`
+	TimestampKeys   []string `json:"timestamp_keys"`
+}
+
+var defaultPayloadKeys = payloadConfig{
+	MessageKeys:     []string{"message", "msg", "Message"},
+	FullMessageKeys: []string{"full_message", "FullMessage"},
+	LevelKeys:       []string{"level", "severity", "Level"},
+	TimestampKeys:   []string{"timestamp", "time", "ts"},
+}
+
+var levelNames = map[string]int32{
+	"emerg":       gelf.LOG_EMERG,
+	"emergency":   gelf.LOG_EMERG,
+	"panic":       gelf.LOG_EMERG,
+	"alert":       gelf.LOG_ALERT,
+	"crit":        gelf.LOG_CRIT,
+	"critical":    gelf.LOG_CRIT,
+	"fatal":       gelf.LOG_CRIT,
+	"err":         gelf.LOG_ERR,
+	"error":       gelf.LOG_ERR,
+	"warn":        gelf.LOG_WARNING,
+	"warning":     gelf.LOG_WARNING,
+	"notice":      gelf.LOG_NOTICE,
+	"info":        gelf.LOG_INFO,
+	"information": gelf.LOG_INFO,
+	"debug":       gelf.LOG_DEBUG,
+	"trace":       gelf.LOG_DEBUG,
+}
+
+// Returns the first payload config for this entry's unit or identifier. Without either, a config applies to every entry
+func payloadFor(entry *SystemdJournalEntry) *payloadConfig {
+	for i := range config.Payloads {
+		payload := &config.Payloads[i]
+
+		if payload.matches(entry) {
+			return payload
+		}
+	}
+
+	return nil
+}
+
+// Decodes the message of the entry when a payload config selects it, before the priority is
+// filtered, so the level of the message counts for priority.min_level
+func decodePayload(entry *SystemdJournalEntry) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	if payload := payloadFor(entry); payload != nil {
+		payload.decode(entry)
+	}
+}
+
+// Replaces parts of the entry with the decoded values. Messages that cannot be decoded are left alone
+func (this *payloadConfig) decode(entry *SystemdJournalEntry) {
+	var values map[string]interface{}
+
+	if this.Format == "logfmt" {
+		values = parseLogfmt(entry.Message)
+	} else if strings.HasPrefix(strings.TrimSpace(entry.Message), "{") {
+		json.Unmarshal([]byte(entry.Message), &values)
+	}
+
+	if len(values) == 0 {
+		return
+	}
+
+	if v, ok := takeKey(values, this.MessageKeys, defaultPayloadKeys.MessageKeys); ok {
+		entry.Message = payloadString(v)
+	}
+
+	if v, ok := takeKey(values, this.FullMessageKeys, defaultPayloadKeys.FullMessageKeys); ok {
+		entry.FullMessage = payloadString(v)
+	}
+
+	if v, ok := takeKey(values, this.LevelKeys, defaultPayloadKeys.LevelKeys); ok {
+		if level, ok := payloadLevel(v); ok {
+			entry.Priority = level
+			entry.Priority_decoded = true
+		} else {
+			values["level"] = v
+		}
+	}
+
+	if v, ok := takeKey(values, this.TimestampKeys, defaultPayloadKeys.TimestampKeys); ok {
+		if ts, ok := payloadTimestamp(v); ok {
+			entry.Event_timestamp = int64(math.Round(ts * 1000 * 1000))
+		} else {
+			values["timestamp"] = v
+		}
+	}
+
+	if entry.Extra == nil {
+		entry.Extra = make(map[string]interface{}, len(values))
+	}
+
+	for key, v := range values {
+		name, ok := gelfFieldName(key)
+		if !ok {
+			continue
+		}
+
+		switch v.(type) {
+		case string, float64:
+			entry.Extra[name] = v
+		default:
+			entry.Extra[name] = payloadString(v)
+		}
+	}
+}
+
+func takeKey(values map[string]interface{}, keys, defaults []string) (interface{}, bool) {
+	if len(keys) == 0 {
+		keys = defaults
+	}
+
+	for _, key := range keys {
+		if v, ok := values[key]; ok {
+			delete(values, key)
+			return v, true
+		}
+	}
+
+	return nil, false
+}
+
+func payloadString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+func payloadLevel(v interface{}) (int32, bool) {
+	switch v := v.(type) {
+	case float64:
+		if v >= gelf.LOG_EMERG && v <= gelf.LOG_DEBUG {
+			return int32(v), true
+		}
+	case string:
+		if level, ok := levelNames[strings.ToLower(v)]; ok {
+			return level, true
+		}
+		if level, err := strconv.Atoi(v); err == nil && level >= gelf.LOG_EMERG && level <= gelf.LOG_DEBUG {
+			return int32(level), true
+		}
+	}
+
+	return 0, false
+}
+
+// Accepts RFC 3339 strings and unix timestamps in seconds, milliseconds, microseconds or
+// nanoseconds, told apart by their magnitude. Seconds stay below 1e11 until the year 5138
+func payloadTimestamp(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		switch {
+		case v < 1e11:
+			return v, true
+		case v < 1e14:
+			return v / 1e3, true
+		case v < 1e17:
+			return v / 1e6, true
+		default:
+			return v / 1e9, true
+		}
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return float64(t.UnixNano()) / float64(time.Second), true
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return payloadTimestamp(f)
+		}
+	}
+
+	return 0, false
+}
+
+// Parses key=value pairs separated by spaces, values may be double quoted. Returns nil when
+// the message contains anything else, since it probably isn't logfmt at all
+func parseLogfmt(s string) map[string]interface{} {
+	values := make(map[string]interface{})
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeftFunc(s, unicode.IsSpace) {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || strings.IndexFunc(s[:eq], unicode.IsSpace) >= 0 {
+			return nil
+		}
+
+		key := s[:eq]
+		s = s[eq+1:]
+
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil
+			}
+
+			value, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil
+			}
+
+			values[key] = value
+			s = s[end+1:]
+		} else {
+			end := strings.IndexFunc(s, unicode.IsSpace)
+			if end < 0 {
+				end = len(s)
+			}
+
+			values[key] = s[:end]
+			s = s[end:]
+		}
+	}
+
+	return values
+}
+
+func (this *payloadConfig) validate(key string) error {
+	if err := this.unitSelector.validate(key); err != nil {
+		return err
+	}
+
+	switch this.Format {
+	case "json", "logfmt":
+	default:
+		return fmt.Errorf("%s.format: unknown format %q, use json or logfmt", key, this.Format)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"math"
+	"testing"
+)
+
+func TestLogfmtMessageDecoded(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Payloads = []payloadConfig{{unitSelector: unitSelector{Units: []string{"api*.service"}}, Format: "logfmt", LevelKeys: []string{"lvl"}}}
+
+	entry := SystemdJournalEntry{}
+
+	err := json.Unmarshal([]byte(`{
+        "MESSAGE" : "ts=1549067421.5 lvl=error msg=\"request failed\" path=/users duration=12ms id=7",
+        "PRIORITY" : "6",
+        "_SYSTEMD_UNIT" : "api-v2.service"
+	}`), &entry)
+
+	AssertNotError(t, err)
+
+	decodePayload(&entry)
+	gelf := entry.toGelf()
+	AssertEquals(t, "request failed", gelf.Short)
+	AssertEquals(t, int32(3), gelf.Level)
+	AssertEquals(t, float64(1549067421.5), gelf.TimeUnix)
+	AssertEquals(t, "/users", gelf.Extra["_path"])
+	AssertEquals(t, "12ms", gelf.Extra["_duration"])
+	AssertEquals(t, nil, gelf.Extra["_id"])
+}
+
+func TestPayloadOnlyDecodedForSelectedUnits(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Payloads = []payloadConfig{{unitSelector: unitSelector{Units: []string{"api.service"}}, Format: "json"}}
+
+	entry := SystemdJournalEntry{}
+
+	err := json.Unmarshal([]byte(`{
+        "MESSAGE" : "{\"message\":\"hello\"}",
+        "_SYSTEMD_UNIT" : "other.service"
+	}`), &entry)
+
+	AssertNotError(t, err)
+
+	decodePayload(&entry)
+	AssertEquals(t, `{"message":"hello"}`, entry.toGelf().Short)
+}
+
+func TestJsonPayloadLevelAndNestedValues(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Payloads = []payloadConfig{{Format: "json"}}
+
+	entry := SystemdJournalEntry{}
+
+	err := json.Unmarshal([]byte(`{
+        "MESSAGE" : "{\"msg\":\"slow query\",\"level\":\"WARN\",\"time\":\"2019-02-02T00:30:21Z\",\"query\":{\"table\":\"users\"},\"rows\":3}"
+	}`), &entry)
+
+	AssertNotError(t, err)
+
+	decodePayload(&entry)
+	gelf := entry.toGelf()
+	AssertEquals(t, "slow query", gelf.Short)
+	AssertEquals(t, int32(4), gelf.Level)
+	AssertEquals(t, float64(1549067421), gelf.TimeUnix)
+	AssertEquals(t, `{"table":"users"}`, gelf.Extra["_query"])
+	AssertEquals(t, float64(3), gelf.Extra["_rows"])
+}
+
+func TestPayloadLevelFilteredByMinLevel(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.Payloads = []payloadConfig{{Format: "json"}}
+	config.Priority.MinLevel = levelPtr(gelf.LOG_INFO)
+
+	entry := SystemdJournalEntry{}
+
+	err := json.Unmarshal([]byte(`{
+        "MESSAGE" : "{\"msg\":\"cache miss\",\"level\":\"debug\"}",
+        "PRIORITY" : "6"
+	}`), &entry)
+
+	AssertNotError(t, err)
+
+	decodePayload(&entry)
+	AssertEquals(t, true, levelFiltered(&entry))
+}
+
+func TestPayloadTimestampUnits(t *testing.T) {
+	for _, v := range []interface{}{1549067421.5, 1549067421500.0, 1549067421500000.0, 1549067421500000000.0, "1549067421500"} {
+		ts, ok := payloadTimestamp(v)
+
+		AssertEquals(t, true, ok)
+		if math.Abs(ts-1549067421.5) > 1e-6 {
+			t.Errorf("%v: expected 1549067421.5, got %f", v, ts)
+		}
+	}
+}
+
+func TestInvalidLogfmtIgnored(t *testing.T) {
+	AssertEquals(t, 0, len(parseLogfmt("just some text")))
+	AssertEquals(t, 0, len(parseLogfmt(`key="unterminated`)))
+	AssertEquals(t, 2, len(parseLogfmt(`a=1 b="two words"`)))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"reflect"
+)
+
+// A syslog priority, from 0 (emerg) to 7 (debug), given as a number or a name like "warning"
+type level int32
+
+var levelType = reflect.TypeOf(level(0))
+
+// Like journald, entries without a priority are informational
+const DEFAULT_LEVEL = gelf.LOG_INFO
+
+// Entries without a PRIORITY field get Default, info unless configured. Remap then translates
+// priorities, and entries less severe than MinLevel are dropped. The first of Overrides matching
+// the unit or identifier of an entry replaces the settings it has
+type priorityConfig struct {
+	Default   level                    `json:"default"`
+	Remap     map[string]level         `json:"remap"`
+	MinLevel  *level                   `json:"min_level"`
+	Overrides []priorityOverrideConfig `json:"overrides"`
+
+	remap map[int32]int32
+}
+
+type priorityOverrideConfig struct {
+	unitSelector
+	Default  *level           `json:"default"`
+	Remap    map[string]level `json:"remap"`
+	MinLevel *level           `json:"min_level"`
+
+	remap map[int32]int32
+}
+
+func (this *level) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	l, ok := payloadLevel(v)
+	if !ok {
+		return fmt.Errorf("unknown level %s", data)
+	}
+
+	*this = level(l)
+
+	return nil
+}
+
+func checkLevel(value interface{}, key string) error {
+	if _, ok := payloadLevel(value); !ok {
+		return fmt.Errorf("%s: expected a level from 0 to 7 or a name like \"warning\"", key)
+	}
+
+	return nil
+}
+
+func compileRemap(remap map[string]level, key string) (map[int32]int32, error) {
+	compiled := make(map[int32]int32, len(remap))
+	for from, to := range remap {
+		l, ok := payloadLevel(from)
+		if !ok {
+			return nil, fmt.Errorf("%s.remap.%s: expected a level from 0 to 7 or a name like \"warning\"", key, from)
+		}
+
+		compiled[l] = int32(to)
+	}
+
+	return compiled, nil
+}
+
+func (this *priorityConfig) validate() error {
+	var err error
+	if this.remap, err = compileRemap(this.Remap, "priority"); err != nil {
+		return err
+	}
+
+	for i := range this.Overrides {
+		override := &this.Overrides[i]
+		key := fmt.Sprintf("priority.overrides[%d]", i)
+
+		if err := override.unitSelector.validate(key); err != nil {
+			return err
+		}
+
+		if override.remap, err = compileRemap(override.Remap, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *priorityConfig) overrideFor(entry *SystemdJournalEntry) *priorityOverrideConfig {
+	for i := range this.Overrides {
+		override := &this.Overrides[i]
+
+		if override.matches(entry) {
+			return override
+		}
+	}
+
+	return nil
+}
+
+// Sets the priority of the entry, also from its message, see severity.go. Reports whether it is
+// less severe than the minimum level and should be dropped, which is counted like a filter named
+// priority.min_level
+func levelFiltered(entry *SystemdJournalEntry) bool {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	priority := &config.Priority
+	defaultLevel, remap, minLevel := priority.Default, priority.remap, priority.MinLevel
+
+	if override := priority.overrideFor(entry); override != nil {
+		if override.Default != nil {
+			defaultLevel = *override.Default
+		}
+		if override.Remap != nil {
+			remap = override.remap
+		}
+		if override.MinLevel != nil {
+			minLevel = override.MinLevel
+		}
+	}
+
+	if _, ok := entry.Fields["PRIORITY"]; !ok && !entry.Priority_decoded {
+		entry.Priority = int32(defaultLevel)
+	}
+
+	if to, ok := remap[entry.Priority]; ok {
+		entry.Priority = to
+	}
+
+	inferSeverity(entry)
+
+	if minLevel != nil && entry.Priority > int32(*minLevel) {
+		metrics.entriesDropped.With("priority.min_level").Inc()
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPriorityDefaultRemapAndMinLevel(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	var err error
+	config, err = loadConfigString(t, `{
+		"destination": "localhost:12201",
+		"priority": {
+			"remap": {"debug": "info"},
+			"min_level": "notice",
+			"overrides": [
+				{"units": ["kernel*"], "default": "warning", "remap": {"0": 3}},
+				{"units": ["noisy.service"], "min_level": 3}
+			]
+		}
+	}`)
+	AssertNotError(t, err)
+
+	for _, test := range []struct {
+		unit, priority string
+		expected       int32
+		dropped        bool
+	}{
+		{"app.service", "", 6, true},
+		{"app.service", "5", 5, false},
+		{"app.service", "0", 0, false},
+		{"app.service", "7", 6, true},
+		{"kernel", "", 4, false},
+		{"kernel", "0", 3, false},
+		{"kernel", "7", 7, true},
+		{"noisy.service", "4", 4, true},
+		{"noisy.service", "3", 3, false},
+	} {
+		fields := map[string]string{"_SYSTEMD_UNIT": test.unit, "MESSAGE": "hello"}
+		if test.priority != "" {
+			fields["PRIORITY"] = test.priority
+		}
+
+		entry := testEntry(t, fields)
+		dropped := levelFiltered(entry)
+
+		if entry.Priority != test.expected || dropped != test.dropped {
+			t.Errorf("%s with priority %q: expected %d dropped %v, got %d dropped %v",
+				test.unit, test.priority, test.expected, test.dropped, entry.Priority, dropped)
+		}
+	}
+}
+
+func TestMissingPriorityIsInfoByDefault(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config = defaultConfig()
+	AssertNotError(t, config.Priority.validate())
+
+	entry := testEntry(t, map[string]string{"_SYSTEMD_UNIT": "app.service", "MESSAGE": "hello"})
+	AssertEquals(t, false, levelFiltered(entry))
+	AssertEquals(t, int32(6), entry.toGelf().Level)
+}
+
+func TestPriorityConfigErrors(t *testing.T) {
+	for data, expected := range map[string]string{
+		`{"destination": "localhost:12201", "priority": {"default": "loud"}}`:                       `priority.default: expected a level from 0 to 7`,
+		`{"destination": "localhost:12201", "priority": {"min_level": 8}}`:                          `priority.min_level: expected a level from 0 to 7`,
+		`{"destination": "localhost:12201", "priority": {"remap": {"9": 1}}}`:                       `priority.remap.9: expected a level from 0 to 7`,
+		`{"destination": "localhost:12201", "priority": {"overrides": [{"identifiers": ["["]}]}}`:   `priority.overrides[0].identifiers[0]: syntax error in pattern`,
+		`{"destination": "localhost:12201", "priority": {"overrides": [{"units": ["a"], "x": 1}]}}`: `priority.overrides[0].x: unknown key`,
+	} {
+		_, err := loadConfigString(t, data)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits entries with the same value of Key to Rate per second, allowing bursts of Burst entries.
+// Entries over the limit are dropped, or with Action "sample" one in every Sample is kept anyway.
+// With a SummaryInterval, a message telling how many entries were suppressed is sent that often.
+// Entries without Key, or that don't pass When when it's set, are not limited
+type rateLimitConfig struct {
+	Name            string           `json:"name"`
+	Key             string           `json:"key"`
+	When            *conditionConfig `json:"when"`
+	Rate            float64          `json:"rate"`
+	Burst           float64          `json:"burst"`
+	Action          string           `json:"action"`
+	Sample          int              `json:"sample"`
+	SummaryInterval duration         `json:"summary_interval"`
+
+	state *rateLimitState
+}
+
+type rateLimitState struct {
+	sync.Mutex
+	buckets     map[string]*tokenBucket
+	lastSummary time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// entries over the limit, the suppressed ones are reset after every summary
+	over       int
+	suppressed int
+}
+
+// How often rate limits are checked for summaries to send, and for buckets that can be forgotten
+const RATE_LIMIT_CHECK_INTERVAL = 1 * time.Second
+
+func (this *rateLimitConfig) validate(key string) error {
+	if this.Key == "" {
+		return fmt.Errorf("%s.key: is required", key)
+	}
+
+	if this.Rate <= 0 {
+		return fmt.Errorf("%s.rate: must be positive", key)
+	}
+
+	if this.Burst == 0 {
+		this.Burst = this.Rate
+	}
+	if this.Burst < 1 {
+		return fmt.Errorf("%s.burst: must be at least 1", key)
+	}
+
+	switch this.Action {
+	case "":
+		this.Action = "drop"
+	case "drop":
+	case "sample":
+		if this.Sample < 2 {
+			return fmt.Errorf("%s.sample: must be at least 2 to keep one in every so many entries", key)
+		}
+	default:
+		return fmt.Errorf("%s.action: unknown action %q, use drop or sample", key, this.Action)
+	}
+
+	if this.SummaryInterval.Duration < 0 {
+		return fmt.Errorf("%s.summary_interval: must not be negative", key)
+	}
+
+	if this.Name == "" {
+		this.Name = key
+	}
+
+	if this.When != nil {
+		if err := this.When.compile(key + ".when"); err != nil {
+			return err
+		}
+	}
+
+	this.state = &rateLimitState{buckets: make(map[string]*tokenBucket), lastSummary: time.Now()}
+
+	return nil
+}
+
+// Refills the bucket for the time passed since it was last used
+func (this *rateLimitConfig) refill(bucket *tokenBucket, now time.Time) {
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * this.Rate
+	if bucket.tokens > this.Burst {
+		bucket.tokens = this.Burst
+	}
+	bucket.updated = now
+}
+
+// Reports whether the entry exceeds the limit and should be dropped
+func (this *rateLimitConfig) limited(entry *SystemdJournalEntry, now time.Time) bool {
+	value, ok := entry.Fields[this.Key]
+	if !ok || (this.When != nil && !this.When.matches(entry.Fields)) {
+		return false
+	}
+
+	this.state.Lock()
+	defer this.state.Unlock()
+
+	bucket, ok := this.state.buckets[value]
+	if !ok {
+		bucket = &tokenBucket{tokens: this.Burst, updated: now}
+		this.state.buckets[value] = bucket
+	}
+
+	this.refill(bucket, now)
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return false
+	}
+
+	bucket.over++
+	if this.Action == "sample" && (bucket.over-1)%this.Sample == 0 {
+		return false
+	}
+
+	bucket.suppressed++
+	metrics.entriesRateLimited.With(this.Name).Inc()
+
+	return true
+}
+
+// Returns the number of suppressed entries by key when a summary is due, and forgets buckets
+// that are full again
+func (this *rateLimitConfig) collect(now time.Time) map[string]int {
+	this.state.Lock()
+	defer this.state.Unlock()
+
+	var suppressed map[string]int
+	if this.SummaryInterval.Duration > 0 && now.Sub(this.state.lastSummary) >= this.SummaryInterval.Duration {
+		suppressed = make(map[string]int)
+		this.state.lastSummary = now
+
+		for value, bucket := range this.state.buckets {
+			if bucket.suppressed > 0 {
+				suppressed[value] = bucket.suppressed
+				bucket.suppressed = 0
+			}
+		}
+	}
+
+	for value, bucket := range this.state.buckets {
+		this.refill(bucket, now)
+		if bucket.tokens >= this.Burst && bucket.suppressed == 0 {
+			delete(this.state.buckets, value)
+		}
+	}
+
+	return suppressed
+}
+
+func rateLimited(entry *SystemdJournalEntry) bool {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	now := time.Now()
+	for i := range config.RateLimits {
+		if config.RateLimits[i].limited(entry, now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sends the summaries that are due, as warnings from SystemdJournal2Gelf itself
+func summarizeRateLimits(now time.Time) {
+	configLock.RLock()
+	limits := config.RateLimits
+	configLock.RUnlock()
+
+	hostname, _ := os.Hostname()
+
+	for i := range limits {
+		limit := &limits[i]
+		suppressed := limit.collect(now)
+
+		var values []string
+		for value := range suppressed {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+
+		for _, value := range values {
+			message := fmt.Sprintf("suppressed %d messages from %s=%s in the last %s by rate limit %s",
+				suppressed[value], limit.Key, value, limit.SummaryInterval.Duration, limit.Name)
+
+			fields := map[string]string{limit.Key: value}
+			fields["MESSAGE"] = message
+			fields["PRIORITY"] = strconv.Itoa(gelf.LOG_WARNING)
+			fields["SYSLOG_IDENTIFIER"] = "SystemdJournal2Gelf"
+			fields["_HOSTNAME"] = hostname
+			fields["__REALTIME_TIMESTAMP"] = strconv.FormatInt(now.UnixNano()/1000, 10)
+
+			var entry SystemdJournalEntry
+			entry.setFields(fields)
+			entry.sendMessage(entry.toGelf())
+		}
+	}
+}
+
+func summarizeRateLimitsEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		summarizeRateLimits(time.Now())
+	}
+}
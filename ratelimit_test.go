@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitRefillsTokens(t *testing.T) {
+	limit := rateLimitConfig{Key: "_SYSTEMD_UNIT", Rate: 10, Burst: 2}
+	AssertNotError(t, limit.validate("rate_limits[0]"))
+
+	a := testEntry(t, map[string]string{"_SYSTEMD_UNIT": "a.service", "MESSAGE": "crash"})
+	b := testEntry(t, map[string]string{"_SYSTEMD_UNIT": "b.service", "MESSAGE": "crash"})
+
+	now := time.Now()
+	AssertEquals(t, false, limit.limited(a, now))
+	AssertEquals(t, false, limit.limited(a, now))
+	AssertEquals(t, true, limit.limited(a, now))
+
+	// other units have their own bucket
+	AssertEquals(t, false, limit.limited(b, now))
+
+	now = now.Add(100 * time.Millisecond)
+	AssertEquals(t, false, limit.limited(a, now))
+	AssertEquals(t, true, limit.limited(a, now))
+
+	// entries without the key aren't limited
+	var entry SystemdJournalEntry
+	AssertEquals(t, false, limit.limited(&entry, now))
+}
+
+func TestRateLimitSamples(t *testing.T) {
+	limit := rateLimitConfig{Key: "_SYSTEMD_UNIT", Rate: 1, Action: "sample", Sample: 3}
+	AssertNotError(t, limit.validate("rate_limits[0]"))
+
+	entry := testEntry(t, map[string]string{"_SYSTEMD_UNIT": "a.service", "MESSAGE": "crash"})
+
+	now := time.Now()
+	var kept []bool
+	for i := 0; i < 8; i++ {
+		kept = append(kept, !limit.limited(entry, now))
+	}
+
+	AssertEquals(t, "[true true false false true false false true]", fmt.Sprint(kept))
+}
+
+func TestRateLimitSummarySent(t *testing.T) {
+	w := &recordingWriter{}
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": w})()
+
+	config.RateLimits = []rateLimitConfig{{Name: "units", Key: "_SYSTEMD_UNIT", Rate: 1, SummaryInterval: duration{time.Minute}}}
+	AssertNotError(t, config.RateLimits[0].validate("rate_limits[0]"))
+
+	entry := testEntry(t, map[string]string{"_SYSTEMD_UNIT": "crashloop.service", "MESSAGE": "crash"})
+	for i := 0; i < 5; i++ {
+		rateLimited(entry)
+	}
+
+	// nothing is sent before the interval passed
+	start := time.Now()
+	summarizeRateLimits(start)
+	AssertEquals(t, 0, len(w.messages))
+
+	summarizeRateLimits(start.Add(time.Minute))
+	AssertEquals(t, 1, len(w.messages))
+	AssertEquals(t, "suppressed 4 messages from _SYSTEMD_UNIT=crashloop.service in the last 1m0s by rate limit units", w.messages[0].Short)
+	AssertEquals(t, int32(4), w.messages[0].Level)
+	AssertEquals(t, "crashloop.service", w.messages[0].Extra["_Systemd_unit"])
+
+	// the count starts over after a summary, and the full bucket is forgotten
+	summarizeRateLimits(start.Add(2 * time.Minute))
+	AssertEquals(t, 1, len(w.messages))
+	AssertEquals(t, 0, len(config.RateLimits[0].state.buckets))
+}
+
+func TestRateLimitConfigErrors(t *testing.T) {
+	for data, expected := range map[string]string{
+		`{"rate": 10}`:             "rate_limits[0].key: is required",
+		`{"key": "_SYSTEMD_UNIT"}`: "rate_limits[0].rate: must be positive",
+		`{"key": "_SYSTEMD_UNIT", "rate": 1, "burst": 0.5}`:                "rate_limits[0].burst: must be at least 1",
+		`{"key": "_SYSTEMD_UNIT", "rate": 1, "action": "sample"}`:          "rate_limits[0].sample: must be at least 2",
+		`{"key": "_SYSTEMD_UNIT", "rate": 1, "summary_interval": "often"}`: "rate_limits[0].summary_interval: time: invalid duration",
+	} {
+		_, err := loadConfigString(t, `{"destination": "localhost:12201", "rate_limits": [`+data+`]}`)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q for %s, got %v", expected, data, err)
+		}
+	}
+}
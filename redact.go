@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Rules are applied in order to the message, full message and every string field that is sent.
+// Hashes are keyed with HashKey, so values can be correlated without being reversible by guessing
+type redactionConfig struct {
+	HashKey string                `json:"hash_key"`
+	Rules   []redactionRuleConfig `json:"rules"`
+}
+
+// Replaces matches of Regex or of a Builtin pattern with Replacement, which may refer to groups like
+// $1, or with a hash of the match when Hash is set. When the pattern has a group named "secret",
+// only that part of the match is replaced
+type redactionRuleConfig struct {
+	Name        string `json:"name"`
+	Builtin     string `json:"builtin"`
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+	Hash        bool   `json:"hash"`
+
+	regex  *regexp.Regexp
+	secret int
+}
+
+const REDACTED = "[REDACTED]"
+
+var builtinRedactions = map[string]string{
+	"bearer":   `(?i)\bbearer\s+(?P<secret>[A-Za-z0-9\-._~+/]+=*)`,
+	"password": `(?i)(?:\b(?:password|passwd|pwd|secret|token|api[_-]?key)\s*[=:]\s*|--?(?:password|passwd)[= ]+)(?P<secret>[^\s&"',;]+)`,
+	"aws_key":  `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	"email":    `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`,
+	"ipv4":     `\b(?:[0-9]{1,3}\.){3}[0-9]{1,3}\b`,
+	"ipv6":     `\b(?:[0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}\b|\b(?:[0-9a-fA-F]{1,4}:){1,6}(?::[0-9a-fA-F]{1,4}){1,6}\b`,
+}
+
+func init() {
+	builtinRedactions["ip"] = builtinRedactions["ipv4"] + "|" + builtinRedactions["ipv6"]
+}
+
+func (this *redactionConfig) validate() error {
+	names := make(map[string]bool)
+
+	for i := range this.Rules {
+		rule := &this.Rules[i]
+		key := fmt.Sprintf("redaction.rules[%d]", i)
+
+		pattern := rule.Regex
+		if (rule.Builtin == "") == (rule.Regex == "") {
+			return fmt.Errorf("%s: use either builtin or regex", key)
+		} else if rule.Builtin != "" {
+			var ok bool
+			if pattern, ok = builtinRedactions[rule.Builtin]; !ok {
+				var builtins []string
+				for name := range builtinRedactions {
+					builtins = append(builtins, name)
+				}
+				sort.Strings(builtins)
+
+				return fmt.Errorf("%s.builtin: unknown pattern %q, use one of %s", key, rule.Builtin, strings.Join(builtins, ", "))
+			}
+		}
+
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%s.regex: %s", key, err)
+		}
+		rule.regex = regex
+		rule.secret = 0
+		for i, name := range regex.SubexpNames() {
+			if name == "secret" {
+				rule.secret = i
+			}
+		}
+
+		if rule.Hash && rule.Replacement != "" {
+			return fmt.Errorf("%s.replacement: cannot be combined with hash", key)
+		} else if rule.Replacement == "" {
+			rule.Replacement = REDACTED
+		}
+
+		// without a key the hashes of guessable values like addresses are easily reversed
+		if rule.Hash && this.HashKey == "" {
+			return fmt.Errorf("redaction.hash_key: is required by %s.hash", key)
+		}
+
+		if rule.Name == "" {
+			rule.Name = rule.Builtin
+		}
+		if rule.Name == "" {
+			rule.Name = key
+		}
+
+		if names[rule.Name] {
+			return fmt.Errorf("%s.name: %q is already used", key, rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	return nil
+}
+
+func (this *redactionConfig) hash(value string) string {
+	mac := hmac.New(sha256.New, []byte(this.HashKey))
+	mac.Write([]byte(value))
+
+	return "[" + hex.EncodeToString(mac.Sum(nil))[:16] + "]"
+}
+
+func (this *redactionConfig) apply(value string) string {
+	for i := range this.Rules {
+		rule := &this.Rules[i]
+
+		matches := rule.regex.FindAllStringSubmatchIndex(value, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		var result []byte
+		last := 0
+		for _, match := range matches {
+			start, end := match[0], match[1]
+			if rule.secret > 0 && match[2*rule.secret] >= 0 {
+				start, end = match[2*rule.secret], match[2*rule.secret+1]
+			}
+
+			result = append(result, value[last:start]...)
+			if rule.Hash {
+				result = append(result, this.hash(value[start:end])...)
+			} else if rule.secret > 0 {
+				result = append(result, rule.Replacement...)
+			} else {
+				result = rule.regex.ExpandString(result, rule.Replacement, value, match)
+			}
+			last = end
+		}
+		value = string(append(result, value[last:]...))
+
+		metrics.redactions.With(rule.Name).Add(uint64(len(matches)))
+	}
+
+	return value
+}
+
+// Applies the redaction rules to everything in the message that was taken from the journal
+func redact(message *gelf.Message) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	if len(config.Redaction.Rules) == 0 {
+		return
+	}
+
+	message.Short = config.Redaction.apply(message.Short)
+	message.Full = config.Redaction.apply(message.Full)
+
+	for name, value := range message.Extra {
+		if s, ok := value.(string); ok {
+			message.Extra[name] = config.Redaction.apply(s)
+		}
+	}
+}
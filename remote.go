@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Listens for systemd-journal-upload, certificates are only used when Cert and Key are set.
+// With TrustedCA, clients must present a certificate signed by it. Uploads that send nothing
+// for ReadTimeout are closed
+type remoteConfig struct {
+	Listen      string   `json:"listen"`
+	Cert        string   `json:"cert"`
+	Key         string   `json:"key"`
+	TrustedCA   string   `json:"trusted_ca"`
+	ReadTimeout duration `json:"read_timeout"`
+}
+
+const (
+	REMOTE_READ_TIMEOUT        = 10 * time.Minute
+	REMOTE_READ_HEADER_TIMEOUT = 10 * time.Second
+	REMOTE_IDLE_TIMEOUT        = 2 * time.Minute
+	REMOTE_MAX_ENTRY_SIZE      = 2 * EXPORT_MAX_FIELD_SIZE
+)
+
+func init() {
+	journalInputs["remote"] = newRemoteReader
+}
+
+// Receives entries in export format, POSTed to /upload by systemd-journal-upload on other hosts
+type remoteReader struct {
+	server       *http.Server
+	maxEntrySize int64
+	entries      chan SystemdJournalEntry
+	failed       chan error
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func newRemoteReader(config journalConfig, cursor *cursorState) (journalReader, error) {
+	this := &remoteReader{
+		maxEntrySize: REMOTE_MAX_ENTRY_SIZE,
+		entries:      make(chan SystemdJournalEntry),
+		failed:       make(chan error, 1),
+		done:         make(chan struct{}),
+	}
+
+	listener, err := net.Listen("tcp", config.Remote.Listen)
+	if err != nil {
+		return nil, err
+	}
+	listener = readTimeoutListener{listener, config.Remote.ReadTimeout.Duration}
+
+	// no ReadTimeout, since the body of an upload that follows the journal never ends, see readTimeoutConn
+	this.server = &http.Server{
+		Handler:           this,
+		ReadHeaderTimeout: REMOTE_READ_HEADER_TIMEOUT,
+		IdleTimeout:       REMOTE_IDLE_TIMEOUT,
+	}
+
+	if config.Remote.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(config.Remote.Cert, config.Remote.Key)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+		if config.Remote.TrustedCA != "" {
+			pem, err := ioutil.ReadFile(config.Remote.TrustedCA)
+			if err != nil {
+				listener.Close()
+				return nil, err
+			}
+
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+				listener.Close()
+				return nil, errors.New("no certificates found in " + config.Remote.TrustedCA)
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	go func() {
+		if err := this.server.Serve(listener); err != http.ErrServerClosed {
+			this.failed <- err
+		}
+	}()
+
+	return this, nil
+}
+
+func (this *remoteReader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/upload" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/vnd.fdo.journal" {
+		http.Error(w, "Content-Type: application/vnd.fdo.journal is required", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// systemd-journal-upload keeps streaming the body while following, so entries are handed over as they
+	// arrive, and only the size of each entry is limited
+	body := &entryLimitReader{r: r.Body, remaining: this.maxEntrySize}
+	d := newExportDecoder(body)
+	for {
+		var entry SystemdJournalEntry
+		if err := entry.decodeExport(d); err == io.EOF {
+			break
+		} else if err == errEntryTooLarge {
+			http.Error(w, fmt.Sprintf("Invalid entry: %s", err), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid entry: %s", err), http.StatusBadRequest)
+			return
+		}
+		body.remaining = this.maxEntrySize
+
+		select {
+		case this.entries <- entry:
+		case <-this.done:
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, "OK.\n")
+}
+
+func (this *remoteReader) Next() (SystemdJournalEntry, error) {
+	select {
+	case entry := <-this.entries:
+		return entry, nil
+	case err := <-this.failed:
+		return SystemdJournalEntry{}, err
+	case <-this.done:
+		return SystemdJournalEntry{}, io.EOF
+	}
+}
+
+func (this *remoteReader) Close() error {
+	var err error
+
+	this.closeOnce.Do(func() {
+		close(this.done)
+		err = this.server.Close()
+	})
+
+	return err
+}
+
+var errEntryTooLarge = errors.New("entry is too large")
+
+// Stops reading once remaining bytes were read, the decoder may read a little ahead of the entry
+type entryLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (this *entryLimitReader) Read(p []byte) (int, error) {
+	if this.remaining <= 0 {
+		return 0, errEntryTooLarge
+	}
+
+	if int64(len(p)) > this.remaining {
+		p = p[:this.remaining]
+	}
+
+	n, err := this.r.Read(p)
+	this.remaining -= int64(n)
+
+	return n, err
+}
+
+type readTimeoutListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (this readTimeoutListener) Accept() (net.Conn, error) {
+	conn, err := this.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &readTimeoutConn{Conn: conn, timeout: this.timeout}, nil
+}
+
+// Every read must complete within timeout, or earlier when the server set a deadline itself,
+// like for reading the request headers. This keeps slow clients from holding connections open
+// without limiting how long an upload may stream
+type readTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+
+	sync.Mutex
+	deadline time.Time
+}
+
+func (this *readTimeoutConn) Read(p []byte) (int, error) {
+	if err := this.applyDeadline(); err != nil {
+		return 0, err
+	}
+
+	return this.Conn.Read(p)
+}
+
+func (this *readTimeoutConn) SetReadDeadline(t time.Time) error {
+	this.Lock()
+	this.deadline = t
+	this.Unlock()
+
+	// also applied right away, to interrupt a pending read
+	return this.applyDeadline()
+}
+
+func (this *readTimeoutConn) SetDeadline(t time.Time) error {
+	if err := this.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+
+	return this.SetReadDeadline(t)
+}
+
+func (this *readTimeoutConn) applyDeadline() error {
+	this.Lock()
+	defer this.Unlock()
+
+	deadline := time.Now().Add(this.timeout)
+	if !this.deadline.IsZero() && this.deadline.Before(deadline) {
+		deadline = this.deadline
+	}
+
+	return this.Conn.SetReadDeadline(deadline)
+}
+
+func (this *remoteConfig) validate() error {
+	if this.Listen == "" {
+		return errors.New("journal.remote.listen: is required for the remote input")
+	}
+
+	if (this.Cert == "") != (this.Key == "") {
+		return errors.New("journal.remote.cert: journal.remote.cert and journal.remote.key must be used together")
+	}
+
+	if this.TrustedCA != "" && this.Cert == "" {
+		return errors.New("journal.remote.trusted_ca: requires journal.remote.cert and journal.remote.key")
+	}
+
+	if this.ReadTimeout.Duration <= 0 {
+		return errors.New("journal.remote.read_timeout: must be positive")
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteUploadForwardsEntries(t *testing.T) {
+	reader := &remoteReader{maxEntrySize: REMOTE_MAX_ENTRY_SIZE, entries: make(chan SystemdJournalEntry), done: make(chan struct{})}
+
+	var body bytes.Buffer
+	body.WriteString("__CURSOR=s=abc;i=1\n_HOSTNAME=small-host\n_MACHINE_ID=0123456789abcdef\nMESSAGE=first\n\n")
+	exportBinaryField(&body, "MESSAGE", "second\nline")
+	body.WriteString("_HOSTNAME=other-host\n\n")
+
+	received := make(chan SystemdJournalEntry, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			entry, _ := reader.Next()
+			received <- entry
+		}
+	}()
+
+	request := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	request.Header.Set("Content-Type", "application/vnd.fdo.journal")
+	response := httptest.NewRecorder()
+	reader.ServeHTTP(response, request)
+
+	AssertEquals(t, http.StatusAccepted, response.Code)
+
+	entry := <-received
+	AssertEquals(t, "small-host", entry.Hostname)
+	AssertEquals(t, "0123456789abcdef", entry.Fields["_MACHINE_ID"])
+	AssertEquals(t, "first", entry.Message)
+
+	entry = <-received
+	AssertEquals(t, "other-host", entry.toGelf().Host)
+	AssertEquals(t, "second\nline", entry.Message)
+}
+
+func TestRemoteUploadRejectsOtherRequests(t *testing.T) {
+	reader := &remoteReader{maxEntrySize: REMOTE_MAX_ENTRY_SIZE, entries: make(chan SystemdJournalEntry), done: make(chan struct{})}
+
+	response := httptest.NewRecorder()
+	reader.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/upload", nil))
+	AssertEquals(t, http.StatusMethodNotAllowed, response.Code)
+
+	response = httptest.NewRecorder()
+	reader.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBufferString("{}")))
+	AssertEquals(t, http.StatusUnsupportedMediaType, response.Code)
+
+	request := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBufferString("MESSAGE\n\x01"))
+	request.Header.Set("Content-Type", "application/vnd.fdo.journal")
+	response = httptest.NewRecorder()
+	reader.ServeHTTP(response, request)
+	AssertEquals(t, http.StatusBadRequest, response.Code)
+}
+
+func TestRemoteUploadLimitsEntrySize(t *testing.T) {
+	reader := &remoteReader{maxEntrySize: 64, entries: make(chan SystemdJournalEntry, 2), done: make(chan struct{})}
+
+	var body bytes.Buffer
+	body.WriteString("MESSAGE=short\n\n")
+	body.WriteString("MESSAGE=" + strings.Repeat("x", 1000) + "\n\n")
+
+	request := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	request.Header.Set("Content-Type", "application/vnd.fdo.journal")
+	response := httptest.NewRecorder()
+	reader.ServeHTTP(response, request)
+
+	AssertEquals(t, http.StatusRequestEntityTooLarge, response.Code)
+	AssertEquals(t, "short", (<-reader.entries).Message)
+}
+
+func TestRemoteConnectionsTimeOutWhenClientStalls(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	conn := &readTimeoutConn{Conn: server, timeout: 10 * time.Millisecond}
+	defer conn.Close()
+
+	_, err := conn.Read(make([]byte, 1))
+	AssertError(t, err)
+
+	// a deadline set by the http server wins when it is earlier
+	AssertNotError(t, conn.SetReadDeadline(time.Now().Add(-time.Second)))
+	conn.timeout = time.Hour
+	_, err = conn.Read(make([]byte, 1))
+	AssertError(t, err)
+}
+
+func TestRemoteEntriesKeepMachineId(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config = defaultConfig()
+	config.Journal.Input = "remote"
+	config.Destination = "udp://localhost:12201"
+	config.Journal.Remote.Listen = ":19532"
+	AssertNotError(t, config.validate())
+	AssertNotError(t, config.validate())
+	AssertEquals(t, 0, len(config.Fields.Allow))
+
+	var entry SystemdJournalEntry
+	AssertNotError(t, entry.setFields(map[string]string{"MESSAGE": "hello", "_MACHINE_ID": "0123456789abcdef"}))
+	AssertEquals(t, "0123456789abcdef", entry.toGelf().Extra["_Machine_id"])
+
+	config.Fields.Deny = append(config.Fields.Deny, "_MACHINE_ID")
+	AssertEquals(t, nil, entry.toGelf().Extra["_Machine_id"])
+}
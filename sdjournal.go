@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const SDJOURNAL_WAIT_TIMEOUT = 1 * time.Second
+
+// The calls into libsystemd the sdjournal input needs, see journal_sdjournal.go. Next reports
+// whether it moved to an entry, the other methods read the entry it is at
+type sdJournal interface {
+	SeekHead() error
+	SeekTail() error
+	SeekCursor(cursor string) error
+	TestCursor(cursor string) bool
+	Next() (bool, error)
+	Previous() error
+	Wait(timeout time.Duration) error
+	Data() ([][]byte, error)
+	Cursor() (string, error)
+	Realtime() (uint64, error)
+	Close() error
+}
+
+// Reads the journal files directly through libsystemd, instead of spawning journalctl
+type sdJournalReader struct {
+	sync.Mutex
+	journal sdJournal
+	follow  bool
+	closed  int32
+	// set when the journal is already positioned at an entry that wasn't returned yet
+	positioned bool
+}
+
+func newSdJournalReaderAt(journal sdJournal, follow bool, cursor string) (*sdJournalReader, error) {
+	this := &sdJournalReader{journal: journal, follow: follow}
+
+	if err := this.seek(cursor); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Positions the journal right after the given cursor, or at the start or end like journalctl does
+func (this *sdJournalReader) seek(cursor string) error {
+	if cursor == "" && this.follow {
+		if err := this.journal.SeekTail(); err != nil {
+			return err
+		}
+
+		// seeking to the tail positions after the last entry, step back so next returns only new ones
+		this.journal.Previous()
+
+		return nil
+	} else if cursor == "" {
+		return this.journal.SeekHead()
+	}
+
+	if err := this.journal.SeekCursor(cursor); err != nil {
+		return err
+	}
+
+	// when the exact entry no longer exists, the journal is positioned at the closest one which wasn't sent yet
+	if ok, err := this.journal.Next(); err == nil && ok && !this.journal.TestCursor(cursor) {
+		this.positioned = true
+	}
+
+	return nil
+}
+
+func (this *sdJournalReader) Next() (SystemdJournalEntry, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	for atomic.LoadInt32(&this.closed) == 0 {
+		if this.positioned {
+			this.positioned = false
+			return this.read()
+		}
+
+		ok, err := this.journal.Next()
+		if err != nil {
+			return SystemdJournalEntry{}, err
+		} else if ok {
+			return this.read()
+		} else if !this.follow {
+			return SystemdJournalEntry{}, io.EOF
+		}
+
+		// also returns when journal files were added or rotated, the next call to Next picks those up
+		if err := this.journal.Wait(SDJOURNAL_WAIT_TIMEOUT); err != nil {
+			return SystemdJournalEntry{}, err
+		}
+	}
+
+	return SystemdJournalEntry{}, io.EOF
+}
+
+// Must be called with the lock held, while positioned at an entry
+func (this *sdJournalReader) read() (SystemdJournalEntry, error) {
+	var entry SystemdJournalEntry
+
+	data, err := this.journal.Data()
+	if err != nil {
+		return entry, err
+	}
+	fields := sdJournalFields(data)
+
+	if fields["__CURSOR"], err = this.journal.Cursor(); err != nil {
+		return entry, err
+	}
+
+	realtime, err := this.journal.Realtime()
+	if err != nil {
+		return entry, err
+	}
+	fields["__REALTIME_TIMESTAMP"] = strconv.FormatUint(realtime, 10)
+
+	err = entry.setFields(fields)
+
+	return entry, err
+}
+
+// Splits FIELD=value pairs. Only the first of repeated values is kept, like with journalctl
+func sdJournalFields(data [][]byte) map[string]string {
+	fields := make(map[string]string, len(data)+2)
+
+	for _, field := range data {
+		i := bytes.IndexByte(field, '=')
+		if i < 0 {
+			continue
+		}
+
+		if _, ok := fields[string(field[:i])]; !ok {
+			fields[string(field[:i])] = string(field[i+1:])
+		}
+	}
+
+	return fields
+}
+
+// Stops a blocked Next within SDJOURNAL_WAIT_TIMEOUT
+func (this *sdJournalReader) Close() error {
+	atomic.StoreInt32(&this.closed, 1)
+
+	this.Lock()
+	defer this.Unlock()
+
+	if this.journal == nil {
+		return nil
+	}
+
+	err := this.journal.Close()
+	this.journal = nil
+
+	return err
+}
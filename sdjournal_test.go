@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// Entries with cursors i=<seq>, in the order of seq. Wait appends the entries of arriving
+type fakeJournal struct {
+	entries  []fakeJournalEntry
+	arriving []fakeJournalEntry
+	pos      int
+	closed   bool
+}
+
+type fakeJournalEntry struct {
+	seq  int
+	data []string
+}
+
+func newFakeJournal(seqs ...int) *fakeJournal {
+	this := &fakeJournal{pos: -1}
+	for _, seq := range seqs {
+		this.entries = append(this.entries, fakeJournalEntry{seq: seq, data: []string{fmt.Sprintf("MESSAGE=entry %d", seq)}})
+	}
+
+	return this
+}
+
+func (this *fakeJournal) SeekHead() error {
+	this.pos = -1
+	return nil
+}
+
+func (this *fakeJournal) SeekTail() error {
+	this.pos = len(this.entries)
+	return nil
+}
+
+// Like sd_journal, the next entry is the one with the cursor, or the first after it
+func (this *fakeJournal) SeekCursor(cursor string) error {
+	var seq int
+	if _, err := fmt.Sscanf(cursor, "i=%d", &seq); err != nil {
+		return err
+	}
+
+	this.pos = len(this.entries) - 1
+	for i, entry := range this.entries {
+		if entry.seq >= seq {
+			this.pos = i - 1
+			break
+		}
+	}
+
+	return nil
+}
+
+func (this *fakeJournal) TestCursor(cursor string) bool {
+	c, _ := this.Cursor()
+	return c == cursor
+}
+
+func (this *fakeJournal) Next() (bool, error) {
+	if this.pos+1 >= len(this.entries) {
+		return false, nil
+	}
+
+	this.pos++
+
+	return true, nil
+}
+
+func (this *fakeJournal) Previous() error {
+	if this.pos > 0 {
+		this.pos--
+	}
+
+	return nil
+}
+
+func (this *fakeJournal) Wait(timeout time.Duration) error {
+	this.entries = append(this.entries, this.arriving...)
+	this.arriving = nil
+
+	return nil
+}
+
+func (this *fakeJournal) Data() ([][]byte, error) {
+	var data [][]byte
+	for _, field := range this.entries[this.pos].data {
+		data = append(data, []byte(field))
+	}
+
+	return data, nil
+}
+
+func (this *fakeJournal) Cursor() (string, error) {
+	if this.pos < 0 || this.pos >= len(this.entries) {
+		return "", nil
+	}
+
+	return fmt.Sprintf("i=%d", this.entries[this.pos].seq), nil
+}
+
+func (this *fakeJournal) Realtime() (uint64, error) {
+	return uint64(this.entries[this.pos].seq) * 1000 * 1000, nil
+}
+
+func (this *fakeJournal) Close() error {
+	this.closed = true
+	return nil
+}
+
+func readSdJournal(t *testing.T, reader *sdJournalReader) []string {
+	var cursors []string
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return cursors
+		}
+		AssertNotError(t, err)
+
+		cursors = append(cursors, entry.Cursor)
+	}
+}
+
+func TestSdJournalResumesAfterCursor(t *testing.T) {
+	reader, err := newSdJournalReaderAt(newFakeJournal(1, 2, 3), false, "i=2")
+	AssertNotError(t, err)
+
+	AssertEquals(t, "[i=3]", fmt.Sprint(readSdJournal(t, reader)))
+}
+
+func TestSdJournalResumesAtNextEntryWhenCursorIsGone(t *testing.T) {
+	reader, err := newSdJournalReaderAt(newFakeJournal(1, 3, 4), false, "i=2")
+	AssertNotError(t, err)
+
+	AssertEquals(t, "[i=3 i=4]", fmt.Sprint(readSdJournal(t, reader)))
+}
+
+func TestSdJournalStartsAtHeadOrTail(t *testing.T) {
+	reader, err := newSdJournalReaderAt(newFakeJournal(1, 2), false, "")
+	AssertNotError(t, err)
+	AssertEquals(t, "[i=1 i=2]", fmt.Sprint(readSdJournal(t, reader)))
+
+	journal := newFakeJournal(1, 2)
+	journal.arriving = newFakeJournal(3).entries
+
+	reader, err = newSdJournalReaderAt(journal, true, "")
+	AssertNotError(t, err)
+
+	entry, err := reader.Next()
+	AssertNotError(t, err)
+	AssertEquals(t, "i=3", entry.Cursor)
+
+	AssertNotError(t, reader.Close())
+	AssertEquals(t, true, journal.closed)
+
+	_, err = reader.Next()
+	AssertEquals(t, io.EOF, err)
+}
+
+func TestSdJournalFieldsConverted(t *testing.T) {
+	journal := newFakeJournal()
+	journal.entries = []fakeJournalEntry{{seq: 7, data: []string{"MESSAGE=first", "MESSAGE=second", "BROKEN", "_PID=42", "EMPTY="}}}
+
+	reader, err := newSdJournalReaderAt(journal, false, "")
+	AssertNotError(t, err)
+
+	entry, err := reader.Next()
+	AssertNotError(t, err)
+	AssertEquals(t, "first", entry.Message)
+	AssertEquals(t, "42", entry.Pid)
+	AssertEquals(t, "i=7", entry.Cursor)
+	AssertEquals(t, int64(7*1000*1000), entry.Realtime_timestamp)
+	AssertEquals(t, "", entry.Fields["EMPTY"])
+	AssertEquals(t, 5, len(entry.Fields))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// Selects entries by their unit or syslog identifier, using shell patterns like "api*.service".
+// Without either, every entry is selected
+type unitSelector struct {
+	Units       []string `json:"units"`
+	Identifiers []string `json:"identifiers"`
+}
+
+func (this *unitSelector) validate(key string) error {
+	if err := checkPatterns(this.Units, key+".units"); err != nil {
+		return err
+	}
+
+	return checkPatterns(this.Identifiers, key+".identifiers")
+}
+
+func checkPatterns(patterns []string, key string) error {
+	for i, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s[%d]: %s", key, i, err)
+		}
+	}
+
+	return nil
+}
+
+func (this *unitSelector) matches(entry *SystemdJournalEntry) bool {
+	return len(this.Units) == 0 && len(this.Identifiers) == 0 ||
+		matchesAny(this.Units, entry.Systemd_unit) ||
+		matchesAny(this.Identifiers, entry.Syslog_identifier)
+}
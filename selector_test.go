@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnitSelectorMatches(t *testing.T) {
+	entry := testEntry(t, map[string]string{"_SYSTEMD_UNIT": "api-1.service", "SYSLOG_IDENTIFIER": "api", "MESSAGE": "hello"})
+
+	for _, test := range []struct {
+		selector unitSelector
+		expected bool
+	}{
+		{unitSelector{}, true},
+		{unitSelector{Units: []string{"api*.service"}}, true},
+		{unitSelector{Units: []string{"web.service"}}, false},
+		{unitSelector{Units: []string{"web.service"}, Identifiers: []string{"api"}}, true},
+		{unitSelector{Identifiers: []string{"worker"}}, false},
+	} {
+		AssertEquals(t, test.expected, test.selector.matches(entry))
+	}
+}
+
+func TestUnitSelectorValidatedEverywhere(t *testing.T) {
+	for data, expected := range map[string]string{
+		`{"destination": "localhost:12201", "timestamps": [{"units": ["["]}]}`:                       `timestamps[0].units[0]: syntax error in pattern`,
+		`{"destination": "localhost:12201", "payloads": [{"identifiers": ["["], "format": "json"}]}`: `payloads[0].identifiers[0]: syntax error in pattern`,
+		`{"destination": "localhost:12201", "severity": [{"units": ["["]}]}`:                         `severity[0].units[0]: syntax error in pattern`,
+		`{"destination": "localhost:12201", "dedup": {"window": "1m", "units": ["["]}}`:              `dedup.units[0]: syntax error in pattern`,
+		`{"destination": "localhost:12201", "dedup": {"unit": ["a"]}}`:                               `dedup.unit: unknown key`,
+	} {
+		_, err := loadConfigString(t, data)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	}
+
+	config, err := loadConfigString(t, `{"destination": "localhost:12201", "dedup": {"window": "1m", "identifiers": ["worker"]}}`)
+	AssertNotError(t, err)
+	AssertEquals(t, "worker", config.Dedup.Identifiers[0])
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"sync"
+)
+
+// Outputs without a spool are written by Workers in the background, in batches of up to BatchSize
+// messages. Once MaxInFlight messages wait for an output, reading the journal waits as well. With
+// no workers, messages are written one at a time before the next entry is read. BatchSize also
+// applies to draining a spool
+type senderConfig struct {
+	Workers     int `json:"workers"`
+	MaxInFlight int `json:"max_in_flight"`
+	BatchSize   int `json:"batch_size"`
+}
+
+const (
+	SENDER_WORKERS       = 1
+	SENDER_MAX_IN_FLIGHT = 1000
+	SENDER_BATCH_SIZE    = 100
+)
+
+func (this *senderConfig) validate() error {
+	if this.Workers < 0 {
+		return fmt.Errorf("sender.workers: must not be negative")
+	}
+
+	if this.MaxInFlight < 1 {
+		return fmt.Errorf("sender.max_in_flight: must be at least 1")
+	}
+
+	if this.BatchSize < 1 {
+		return fmt.Errorf("sender.batch_size: must be at least 1")
+	}
+
+	return nil
+}
+
+// A message on its way to an output. Realtime is the __REALTIME_TIMESTAMP of its entry, in
+// microseconds, for the cursor lag. Entry is acknowledged once a worker wrote the message
+type outbound struct {
+	message  *gelf.Message
+	realtime int64
+	entry    *trackedEntry
+}
+
+// Starts the workers that write what deliver queues, unless messages are written right away
+func (this *output) startSender(sender senderConfig) {
+	if sender.Workers == 0 {
+		return
+	}
+
+	this.queue = make(chan outbound, sender.MaxInFlight)
+	for i := 0; i < sender.Workers; i++ {
+		go this.send(sender.BatchSize)
+	}
+}
+
+// Writes the first queued message together with those queued after it, then acknowledges them
+func (this *output) send(batchSize int) {
+	batch := make([]outbound, 0, batchSize)
+
+	for first := range this.queue {
+		batch = append(batch[:0], first)
+
+	collect:
+		for len(batch) < batchSize {
+			select {
+			case next := <-this.queue:
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+
+		if !this.writeMessages(batch) {
+			continue
+		}
+
+		for _, queued := range batch {
+			acks.done(queued.entry)
+		}
+	}
+}
+
+// Keeps the cursor from moving past entries that are still being sent. Entries are tracked in the
+// order they are read, and the cursor moves to the last one of those at the front that are done
+type ackTracker struct {
+	sync.Mutex
+	cond    *sync.Cond
+	pending []*trackedEntry
+}
+
+// The deliveries of an entry that haven't finished yet, including the one of the sender itself
+type trackedEntry struct {
+	cursor    string
+	realtime  int64
+	remaining int
+}
+
+var acks = newAckTracker()
+
+func newAckTracker() *ackTracker {
+	this := &ackTracker{}
+	this.cond = sync.NewCond(&this.Mutex)
+
+	return this
+}
+
+// Starts tracking an entry, which is done once done is called for it and for every add
+func (this *ackTracker) track(cursor string, realtime int64) *trackedEntry {
+	this.Lock()
+	defer this.Unlock()
+
+	entry := &trackedEntry{cursor: cursor, realtime: realtime, remaining: 1}
+	this.pending = append(this.pending, entry)
+
+	return entry
+}
+
+// Adds a delivery that finishes later
+func (this *ackTracker) add(entry *trackedEntry) {
+	this.Lock()
+	defer this.Unlock()
+
+	entry.remaining++
+}
+
+func (this *ackTracker) done(entry *trackedEntry) {
+	this.Lock()
+	defer this.Unlock()
+
+	entry.remaining--
+
+	last := ""
+	for len(this.pending) > 0 && this.pending[0].remaining == 0 {
+		if this.pending[0].cursor != "" {
+			last = this.pending[0].cursor
+		}
+
+		this.pending[0] = nil
+		this.pending = this.pending[1:]
+	}
+
+	cursor.Update(last)
+
+	if len(this.pending) == 0 {
+		this.cond.Broadcast()
+	}
+}
+
+// Blocks until every tracked entry is done, or returns false once expired is closed
+func (this *ackTracker) WaitEmpty(expired <-chan struct{}) bool {
+	this.Lock()
+	defer this.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go broadcastOnExpiry(this.cond, expired, stop)
+
+	for len(this.pending) > 0 {
+		select {
+		case <-expired:
+			return false
+		default:
+		}
+
+		this.cond.Wait()
+	}
+
+	return true
+}
+
+// Wakes those waiting for cond once expired is closed, unless stop is closed first
+func broadcastOnExpiry(cond *sync.Cond, expired, stop <-chan struct{}) {
+	select {
+	case <-expired:
+		cond.L.Lock()
+		cond.Broadcast()
+		cond.L.Unlock()
+	case <-stop:
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"net"
+	"testing"
+	"time"
+)
+
+// Blocks every write until the test lets it through
+type gatedWriter struct {
+	recordingWriter
+	gate chan bool
+}
+
+func (this *gatedWriter) WriteMessage(m *gelf.Message) error {
+	<-this.gate
+	return this.recordingWriter.WriteMessage(m)
+}
+
+func useCursor() func() {
+	previous := cursor
+	cursor = &cursorState{}
+
+	return func() {
+		cursor = previous
+	}
+}
+
+func TestCursorWaitsForEarlierEntries(t *testing.T) {
+	defer useCursor()()
+
+	tracker := newAckTracker()
+	first, second, third := tracker.track("s=1", 0), tracker.track("s=2", 0), tracker.track("s=3", 0)
+	tracker.add(first)
+
+	tracker.done(second)
+	tracker.done(first)
+	AssertEquals(t, "", cursor.Get())
+
+	tracker.done(third)
+	AssertEquals(t, "", cursor.Get())
+
+	tracker.done(first)
+	AssertEquals(t, "s=3", cursor.Get())
+	AssertEquals(t, 0, len(tracker.pending))
+}
+
+func TestSenderWritesInBackground(t *testing.T) {
+	defer useCursor()()
+
+	w := &recordingWriter{}
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": w})()
+
+	output := outputs["default"]
+	output.startSender(senderConfig{Workers: 2, MaxInFlight: 10, BatchSize: 3})
+	defer close(output.queue)
+
+	for _, short := range []string{"first", "second", "third", "fourth"} {
+		entry := acks.track("s="+short, 0)
+		output.deliver(entry, &gelf.Message{Short: short})
+		acks.done(entry)
+	}
+
+	acks.WaitEmpty(nil)
+
+	AssertEquals(t, 4, len(w.messages))
+	AssertEquals(t, "s=fourth", cursor.Get())
+}
+
+func TestSenderAppliesBackpressure(t *testing.T) {
+	defer useCursor()()
+
+	w := &gatedWriter{gate: make(chan bool)}
+	output := &output{name: "default", writer: w}
+
+	output.startSender(senderConfig{Workers: 1, MaxInFlight: 1, BatchSize: 1})
+	defer close(output.queue)
+
+	delivered := make(chan bool)
+	go func() {
+		for _, short := range []string{"first", "second", "third"} {
+			entry := acks.track("s="+short, 0)
+			output.deliver(entry, &gelf.Message{Short: short})
+			acks.done(entry)
+		}
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+		t.Fatal("expected delivery to wait for the writer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	AssertEquals(t, "", cursor.Get())
+
+	close(w.gate)
+	<-delivered
+	acks.WaitEmpty(nil)
+
+	AssertEquals(t, 3, len(w.messages))
+	AssertEquals(t, "s=third", cursor.Get())
+}
+
+func TestStreamWriterSendsBatchesAtOnce(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertNotError(t, err)
+	defer listener.Close()
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			close(received)
+			return
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+
+		var shorts []string
+		for len(shorts) < 2 {
+			data, err := reader.ReadBytes(0)
+			if err != nil {
+				t.Error(err)
+				break
+			}
+
+			var m gelf.Message
+			if err := m.UnmarshalJSON(data[:len(data)-1]); err != nil {
+				t.Error(err)
+			}
+			shorts = append(shorts, m.Short)
+		}
+		received <- shorts
+	}()
+
+	w, err := newWriter("tcp://"+listener.Addr().String(), tlsOptions{}, defaultHTTPOptions)
+	AssertNotError(t, err)
+	defer w.Close()
+
+	n, err := w.(batchWriter).WriteMessages(testMessages("first", "second"))
+	AssertNotError(t, err)
+	AssertEquals(t, 2, n)
+
+	shorts := <-received
+	AssertEquals(t, 2, len(shorts))
+	AssertEquals(t, "first", shorts[0])
+	AssertEquals(t, "second", shorts[1])
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Derives the priority of entries of the selected units or identifiers from markers in their
+// message, for services that log everything to stdout with the same priority. The first marker
+// that matches decides, the built-in ones unless Markers are given. The priority the entry had
+// is kept in Field
+type severityConfig struct {
+	unitSelector
+	Markers []severityMarkerConfig `json:"markers"`
+	Field   string                 `json:"field"`
+
+	markers []severityMarkerConfig
+	field   string
+}
+
+// Sets Level when Regex matches, or the level named by the group "level" of Regex, like "error" or "3"
+type severityMarkerConfig struct {
+	Regex string `json:"regex"`
+	Level *level `json:"level"`
+
+	regex *regexp.Regexp
+	group int
+}
+
+var defaultSeverityMarkers = []severityMarkerConfig{
+	{Regex: `^<(?P<level>[0-7])>`},
+	{Regex: `^\[[FC]\]`, Level: levelPtr(2)},
+	{Regex: `^\[E\]`, Level: levelPtr(3)},
+	{Regex: `^\[W\]`, Level: levelPtr(4)},
+	{Regex: `^\[I\]`, Level: levelPtr(6)},
+	{Regex: `^\[D\]`, Level: levelPtr(7)},
+	{Regex: `(?i)\blevel=["']?(?P<level>[a-z]+|[0-7])\b`},
+	{Regex: `\b(?P<level>EMERG|ALERT|CRIT|CRITICAL|FATAL|PANIC|ERROR|ERR|WARN|WARNING|NOTICE|INFO|DEBUG|TRACE)\b`},
+}
+
+const DEFAULT_SEVERITY_FIELD = "original_priority"
+
+func levelPtr(l level) *level {
+	return &l
+}
+
+func (this *severityConfig) compile(key string) error {
+	if err := this.unitSelector.validate(key); err != nil {
+		return err
+	}
+
+	markers, markersKey := this.Markers, key+".markers"
+	if len(markers) == 0 {
+		markers, markersKey = defaultSeverityMarkers, "default markers"
+	}
+
+	this.markers = make([]severityMarkerConfig, len(markers))
+	for i, marker := range markers {
+		markerKey := fmt.Sprintf("%s[%d]", markersKey, i)
+
+		regex, err := regexp.Compile(marker.Regex)
+		if err != nil {
+			return fmt.Errorf("%s.regex: %s", markerKey, err)
+		}
+
+		marker.regex = regex
+		marker.group = 0
+		for i, name := range regex.SubexpNames() {
+			if name == "level" {
+				marker.group = i
+			}
+		}
+
+		if (marker.Level == nil) == (marker.group == 0) {
+			return fmt.Errorf("%s: use either level or a group named level in the regex", markerKey)
+		}
+
+		this.markers[i] = marker
+	}
+
+	field := this.Field
+	if field == "" {
+		field = DEFAULT_SEVERITY_FIELD
+	}
+
+	name, ok := gelfFieldName(field)
+	if !ok {
+		return fmt.Errorf("%s.field: %q cannot be used as a field name", key, this.Field)
+	}
+	this.field = name
+
+	return nil
+}
+
+// The level of the first marker matching the message
+func (this *severityConfig) infer(message string) (int32, bool) {
+	for i := range this.markers {
+		marker := &this.markers[i]
+
+		match := marker.regex.FindStringSubmatchIndex(message)
+		if match == nil {
+			continue
+		}
+
+		if marker.Level != nil {
+			return int32(*marker.Level), true
+		}
+
+		// the level group may be in an alternative that didn't match
+		if match[2*marker.group] < 0 {
+			continue
+		}
+
+		if l, ok := payloadLevel(message[match[2*marker.group]:match[2*marker.group+1]]); ok {
+			return l, true
+		}
+	}
+
+	return 0, false
+}
+
+// Replaces the priority of the entry by the one found in its message, unless its payload had a
+// level. Must be called with configLock held
+func inferSeverity(entry *SystemdJournalEntry) {
+	if entry.Priority_decoded {
+		return
+	}
+
+	for i := range config.Severity {
+		severity := &config.Severity[i]
+		if !severity.matches(entry) {
+			continue
+		}
+
+		if l, ok := severity.infer(entry.Message); ok {
+			if entry.Extra == nil {
+				entry.Extra = make(map[string]interface{})
+			}
+			entry.Extra[severity.field] = entry.Priority
+			entry.Priority = l
+		}
+
+		return
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSeverityFromDefaultMarkers(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config = defaultConfig()
+	config.Severity = []severityConfig{{unitSelector: unitSelector{Units: []string{"legacy*.service"}}}}
+	AssertNotError(t, config.Severity[0].compile("severity[0]"))
+
+	for _, test := range []struct {
+		unit, message string
+		expected      int32
+	}{
+		{"legacy.service", "<3>disk failed", 3},
+		{"legacy.service", "[E] disk failed", 3},
+		{"legacy.service", "[W] disk almost full", 4},
+		{"legacy.service", "time=now level=warn msg=\"disk almost full\"", 4},
+		{"legacy.service", "2021-02-28 ERROR [main] disk failed", 3},
+		{"legacy.service", "FATAL: out of memory", 2},
+		{"legacy.service", "WARNING: disk almost full", 4},
+		{"legacy.service", "an error occurred", 6},
+		{"legacy.service", "level=verbose ERROR disk failed", 3},
+		{"other.service", "ERROR disk failed", 6},
+	} {
+		entry := testEntry(t, map[string]string{"_SYSTEMD_UNIT": test.unit, "PRIORITY": "6", "MESSAGE": test.message})
+		levelFiltered(entry)
+
+		AssertEquals(t, test.expected, entry.Priority)
+		if test.expected != 6 {
+			AssertEquals(t, int32(6), entry.toGelf().Extra["_original_priority"])
+		} else {
+			AssertEquals(t, nil, entry.toGelf().Extra["_original_priority"])
+		}
+	}
+}
+
+func TestSeverityFromCustomMarkersBeforeMinLevel(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	var err error
+	config, err = loadConfigString(t, `{
+		"destination": "localhost:12201",
+		"priority": {"min_level": "info"},
+		"severity": [{
+			"identifiers": ["worker"],
+			"field": "stdout_priority",
+			"markers": [
+				{"regex": "^\\s*at ", "level": "debug"},
+				{"regex": "^(?P<level>[A-Z]+):"}
+			]
+		}]
+	}`)
+	AssertNotError(t, err)
+
+	var entry SystemdJournalEntry
+	AssertNotError(t, entry.setFields(map[string]string{"SYSLOG_IDENTIFIER": "worker", "PRIORITY": "6", "MESSAGE": "CRITICAL: stopped"}))
+	AssertEquals(t, false, levelFiltered(&entry))
+	AssertEquals(t, int32(2), entry.Priority)
+	AssertEquals(t, int32(6), entry.toGelf().Extra["_stdout_priority"])
+
+	AssertNotError(t, entry.setFields(map[string]string{"SYSLOG_IDENTIFIER": "worker", "PRIORITY": "6", "MESSAGE": "  at Main.java:12"}))
+	AssertEquals(t, true, levelFiltered(&entry))
+}
+
+func TestSeverityMarkerWithoutLevelInMatch(t *testing.T) {
+	severity := severityConfig{unitSelector: unitSelector{Units: []string{"a"}}, Markers: []severityMarkerConfig{
+		{Regex: `(?P<level>ERROR)|FAIL`},
+		{Regex: `FAIL`, Level: levelPtr(4)},
+	}}
+	AssertNotError(t, severity.compile("severity[0]"))
+
+	l, ok := severity.infer("job ERROR")
+	AssertEquals(t, true, ok)
+	AssertEquals(t, int32(3), l)
+
+	l, ok = severity.infer("job FAIL")
+	AssertEquals(t, true, ok)
+	AssertEquals(t, int32(4), l)
+}
+
+func TestSeverityConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		severity severityConfig
+		expected string
+	}{
+		{severityConfig{unitSelector: unitSelector{Units: []string{"["}}}, "severity[0].units[0]: syntax error in pattern"},
+		{severityConfig{unitSelector: unitSelector{Units: []string{"a"}}, Markers: []severityMarkerConfig{{Regex: "("}}}, "severity[0].markers[0].regex: "},
+		{severityConfig{unitSelector: unitSelector{Units: []string{"a"}}, Markers: []severityMarkerConfig{{Regex: "ERROR"}}}, "severity[0].markers[0]: use either level or a group named level in the regex"},
+		{severityConfig{unitSelector: unitSelector{Units: []string{"a"}}, Field: "id"}, `severity[0].field: "id" cannot be used as a field name`},
+	} {
+		err := test.severity.compile("severity[0]")
+		if err == nil || !strings.HasPrefix(err.Error(), test.expected) {
+			t.Errorf("expected error %q, got %v", test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Closed once timing.shutdown_timeout passed after a signal, sends that are still waiting for an
+// output give up then. Started by the signal, or by shutdown when everything is sent before exiting
+type deadline struct {
+	sync.Mutex
+	expired chan struct{}
+	timer   *time.Timer
+}
+
+var shutdownDeadline = newDeadline()
+
+func newDeadline() *deadline {
+	return &deadline{expired: make(chan struct{})}
+}
+
+func (this *deadline) Done() <-chan struct{} {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.expired
+}
+
+// Only the first call with a timeout starts the timer, 0 waits forever
+func (this *deadline) Start(timeout time.Duration) {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.timer != nil || timeout == 0 {
+		return
+	}
+
+	expired := this.expired
+	this.timer = time.AfterFunc(timeout, func() { close(expired) })
+}
+
+// Stops reading on SIGTERM and SIGINT, which makes the reader return io.EOF, and reloads on SIGHUP.
+// The returned channel is closed before the reader is stopped.
+func handleSignals(reader journalReader, configFile string) <-chan struct{} {
+	stopping := make(chan struct{})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				reload(configFile)
+				continue
+			}
+
+			fmt.Fprintln(os.Stderr, "shutdown - received "+sig.String()+", sending pending entries")
+
+			// a second signal stops right away
+			signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+
+			configLock.RLock()
+			shutdownDeadline.Start(config.Timing.ShutdownTimeout.Duration)
+			configLock.RUnlock()
+
+			close(stopping)
+			reader.Close()
+		}
+	}()
+
+	return stopping
+}
+
+// Sends the pending entry and waits for the spool to drain, giving up after timeout unless it's 0,
+// or once the timeout that was started by a signal passed. Entries that weren't sent by then remain
+// in the spool, or are read again when a cursor file is used. The returned channel is closed once
+// the sends that were given up on returned as well.
+func shutdown(pending *pendingEntry, timeout time.Duration) <-chan struct{} {
+	shutdownDeadline.Start(timeout)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		pending.Clear()
+		summarizeDuplicates(time.Now(), true)
+		if !acks.WaitEmpty(shutdownDeadline.Done()) {
+			return
+		}
+		flushState()
+		for _, output := range sortedOutputs() {
+			if !output.spool.WaitEmpty(shutdownDeadline.Done()) {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-shutdownDeadline.Done():
+		fmt.Fprintln(os.Stderr, "shutdown - gave up sending after "+timeout.String())
+	}
+
+	flushState()
+	closeOutputs(outputs)
+
+	return done
+}
+
+// Reads the config file again and reconnects to the destination. Settings that are only used
+// at startup keep their current value. Without a config file, only the destination is reopened.
+func reload(configFile string) {
+	configLock.RLock()
+	current := config
+	configLock.RUnlock()
+
+	next := current
+	if configFile != "" {
+		c, err := loadConfig(configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "config - not reloaded because of: "+err.Error())
+			return
+		}
+		next = c
+	}
+
+	if keepStartupSettings(&next, current) {
+		fmt.Fprintln(os.Stderr, "config - changes to journal, cursor_file, metrics, timing.write_interval, sender, the names of outputs and their spool require a restart")
+	}
+	keepState(&next, current)
+
+	writers := make(map[string]gelf.Writer, len(outputs))
+	for name, output := range next.outputConfigs() {
+		w, err := newWriter(output.Destination, output.TLS, output.HTTP)
+		if err != nil {
+			for _, w := range writers {
+				w.Close()
+			}
+
+			fmt.Fprintf(os.Stderr, "config - not reloaded, could not reopen output %s: %s\n", name, err)
+			return
+		}
+
+		writers[name] = w
+	}
+
+	configLock.Lock()
+	config = next
+	for name, w := range writers {
+		writers[name], outputs[name].writer = outputs[name].writer, w
+	}
+	configLock.Unlock()
+
+	// the previous writers
+	for _, w := range writers {
+		w.Close()
+	}
+
+	fmt.Fprintln(os.Stderr, "config - reloaded")
+}
+
+// Copies the settings that can't change while running from current, and reports whether any differed
+func keepStartupSettings(next *Config, current Config) bool {
+	changed := !reflect.DeepEqual(next.Journal, current.Journal) ||
+		next.CursorFile != current.CursorFile ||
+		next.Metrics != current.Metrics ||
+		next.Sender != current.Sender ||
+		next.Timing.WriteInterval != current.Timing.WriteInterval
+
+	next.Journal = current.Journal
+	next.CursorFile = current.CursorFile
+	next.Metrics = current.Metrics
+	next.Sender = current.Sender
+	next.Timing.WriteInterval = current.Timing.WriteInterval
+
+	nextOutputs, currentOutputs := next.outputConfigs(), current.outputConfigs()
+
+	sameNames := len(nextOutputs) == len(currentOutputs)
+	for name := range nextOutputs {
+		_, ok := currentOutputs[name]
+		sameNames = sameNames && ok
+	}
+
+	// routes could refer to outputs that don't exist yet
+	if !sameNames {
+		next.Destination, next.TLS, next.HTTP, next.Spool = current.Destination, current.TLS, current.HTTP, current.Spool
+		next.Outputs, next.Routes = current.Outputs, current.Routes
+		return true
+	}
+
+	for name, output := range nextOutputs {
+		if output.Spool == currentOutputs[name].Spool {
+			continue
+		}
+
+		output.Spool = currentOutputs[name].Spool
+		if len(next.Outputs) == 0 {
+			next.Spool = output.Spool
+		} else {
+			next.Outputs[name] = output
+		}
+		changed = true
+	}
+
+	return changed
+}
+
+// Keeps what was collected while running, so summaries of repeated and rate limited messages
+// aren't lost. Rate limits are matched by name
+func keepState(next *Config, current Config) {
+	if current.Dedup.state != nil {
+		next.Dedup.state = current.Dedup.state
+	}
+
+	states := make(map[string]*rateLimitState, len(current.RateLimits))
+	for _, limit := range current.RateLimits {
+		states[limit.Name] = limit.state
+	}
+
+	for i := range next.RateLimits {
+		if state, ok := states[next.RateLimits[i].Name]; ok {
+			next.RateLimits[i].state = state
+		}
+	}
+}
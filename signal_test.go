@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Resets the shutdown deadline after the test, and forgets the entries of which sending was given up
+func useShutdownDeadline() func() {
+	return func() {
+		shutdownDeadline.Lock()
+		if shutdownDeadline.timer != nil {
+			shutdownDeadline.timer.Stop()
+		}
+		shutdownDeadline.timer = nil
+		shutdownDeadline.expired = make(chan struct{})
+		shutdownDeadline.Unlock()
+
+		acks.Lock()
+		acks.pending = nil
+		acks.Unlock()
+	}
+}
+
+func TestShutdownSendsPendingEntry(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defer useShutdownDeadline()()
+	w := &recordingWriter{}
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": w})()
+
+	var pending pendingEntry
+	pending.Push(SystemdJournalEntry{Cursor: "c1", Message: "last words"})
+
+	shutdown(&pending, time.Second)
+
+	AssertEquals(t, 1, len(w.messages))
+	AssertEquals(t, "last words", w.messages[0].Short)
+	AssertEquals(t, true, w.closed)
+}
+
+func TestShutdownGivesUpAfterTimeout(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defer useShutdownDeadline()()
+	w := &recordingWriter{err: errors.New("unreachable")}
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": w})()
+
+	config.Timing.SleepAfterError.Duration = 10 * time.Millisecond
+
+	var pending pendingEntry
+	pending.Push(SystemdJournalEntry{Cursor: "c1", Message: "never sent"})
+
+	start := time.Now()
+	abandoned := shutdown(&pending, 50*time.Millisecond)
+
+	if time.Since(start) > time.Second {
+		t.Errorf("shutdown took %s", time.Since(start))
+	}
+	AssertEquals(t, true, w.closed)
+
+	// the abandoned send stops retrying as well
+	<-abandoned
+	AssertEquals(t, 0, len(w.messages))
+}
+
+func TestSigtermStopsSendingThatBlocksReading(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defer useShutdownDeadline()()
+	defer useCursor()()
+	w := &recordingWriter{err: errors.New("unreachable")}
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": w})()
+
+	config.Timing.SleepAfterError.Duration = 10 * time.Millisecond
+	config.Timing.ShutdownTimeout.Duration = 50 * time.Millisecond
+
+	output := outputs["default"]
+	output.queue = make(chan outbound, 1)
+	stopped := make(chan struct{})
+	go func() {
+		output.send(1)
+		close(stopped)
+	}()
+
+	// the worker retries the first entry, the second fills the queue and the third waits for it
+	var pending pendingEntry
+	pushed := make(chan struct{})
+	go func() {
+		for _, c := range []string{"c1", "c2", "c3", "c4"} {
+			pending.Push(SystemdJournalEntry{Cursor: c, Message: "lost " + c})
+		}
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("expected reading to wait for the output")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	start := time.Now()
+	stopping := handleSignals(&scriptedReader{}, "")
+	AssertNotError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	<-stopping
+	<-pushed
+	<-shutdown(&pending, config.Timing.ShutdownTimeout.Duration)
+
+	if time.Since(start) > time.Second {
+		t.Errorf("stopping took %s", time.Since(start))
+	}
+	AssertEquals(t, true, w.closed)
+	AssertEquals(t, "", cursor.Get())
+
+	close(output.queue)
+	<-stopped
+}
+
+func TestReloadReplacesWriterAndKeepsStartupSettings(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	AssertNotError(t, err)
+	defer listener.Close()
+
+	f, err := ioutil.TempFile("", "config")
+	AssertNotError(t, err)
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{"destination": "udp://` + listener.LocalAddr().String() + `", "cursor_file": "/elsewhere", "fields": {"style": "journal"}}`)
+	f.Close()
+
+	w := &recordingWriter{}
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": w})()
+	config.CursorFile = "/var/lib/cursor"
+
+	reload(f.Name())
+	defer outputs["default"].writer.Close()
+
+	AssertEquals(t, true, w.closed)
+	AssertNotEquals(t, w, outputs["default"].writer)
+	AssertEquals(t, "journal", config.Fields.Style)
+	AssertEquals(t, "/var/lib/cursor", config.CursorFile)
+
+	// an invalid config leaves everything as it was
+	current := outputs["default"].writer
+	f, err = os.Create(f.Name())
+	AssertNotError(t, err)
+	f.WriteString(`{"destination": "smtp://localhost"}`)
+	f.Close()
+
+	reload(f.Name())
+	AssertEquals(t, current, outputs["default"].writer)
+}
+
+func TestReloadKeepsRepeatedMessages(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": {}})()
+
+	f, err := ioutil.TempFile("", "config")
+	AssertNotError(t, err)
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{"destination": "udp://127.0.0.1:12201", "dedup": {"window": "10s"}}`)
+	f.Close()
+
+	config.Dedup.Window.Duration = 10 * time.Second
+	AssertNotError(t, config.Dedup.validate())
+
+	for _, seconds := range []int64{1000, 1001} {
+		entry := testEntry(t, map[string]string{
+			"_SYSTEMD_UNIT": "flaky.service", "PRIORITY": "3", "MESSAGE": "disk full",
+			"__REALTIME_TIMESTAMP": strconv.FormatInt(seconds*1000*1000, 10),
+		})
+		config.Dedup.suppress(entry, time.Now())
+	}
+
+	reload(f.Name())
+	defer outputs["default"].writer.Close()
+
+	expired := config.Dedup.expire(time.Now(), true)
+	AssertEquals(t, 1, len(expired))
+	AssertEquals(t, 1, expired[0].repeats)
+}
+
+func TestReloadKeepsRateLimitedCounts(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	defer useOutputs(t, nil, map[string]*recordingWriter{"default": {}})()
+
+	f, err := ioutil.TempFile("", "config")
+	AssertNotError(t, err)
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{"destination": "udp://127.0.0.1:12201", "rate_limits": [
+		{"name": "units", "key": "_SYSTEMD_UNIT", "rate": 2, "burst": 1, "summary_interval": "1m"},
+		{"name": "new", "key": "_PID", "rate": 1}
+	]}`)
+	f.Close()
+
+	config.RateLimits = []rateLimitConfig{{Name: "units", Key: "_SYSTEMD_UNIT", Rate: 1, SummaryInterval: duration{time.Minute}}}
+	AssertNotError(t, config.RateLimits[0].validate("rate_limits[0]"))
+
+	entry := testEntry(t, map[string]string{"_SYSTEMD_UNIT": "a.service", "MESSAGE": "crash"})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		config.RateLimits[0].limited(entry, now)
+	}
+
+	reload(f.Name())
+	defer outputs["default"].writer.Close()
+
+	AssertEquals(t, 2, len(config.RateLimits))
+	AssertEquals(t, float64(2), config.RateLimits[0].Rate)
+	AssertEquals(t, 2, config.RateLimits[0].collect(now.Add(time.Minute))["a.service"])
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SPOOL_SEGMENT_SIZE = 4 * 1024 * 1024
+	SPOOL_POSITION     = "position"
+)
+
+// A single line in a segment file. Extra is kept separately because gelf.Message doesn't marshal it
+type spoolRecord struct {
+	Cursor   string                 `json:"cursor,omitempty"`
+	Realtime int64                  `json:"realtime,omitempty"`
+	Message  *gelf.Message          `json:"message"`
+	Extra    map[string]interface{} `json:"extra,omitempty"`
+}
+
+type spoolSegment struct {
+	id       uint64
+	size     int64
+	records  int
+	modified time.Time
+}
+
+func (this *spoolSegment) name() string {
+	return fmt.Sprintf("%020d.seg", this.id)
+}
+
+// Bounded on-disk queue between the journal reader and the writer. Entries are
+// appended to the newest segment file, Next and Ack consume them from the oldest
+// one. When maxSize or maxAge is exceeded, the oldest segments are dropped first
+type diskSpool struct {
+	sync.Mutex
+	cond     *sync.Cond
+	dir      string
+	maxSize  int64
+	maxAge   time.Duration
+	segments []*spoolSegment
+	head     *os.File
+
+	reader      *bufio.Reader
+	readFile    *os.File
+	readOffset  int64
+	readRecords int
+	// records returned by Next or NextBatch and not acknowledged yet, with their size and the
+	// number of unreadable lines between them
+	peeked        []*spoolRecord
+	peekedLen     int64
+	peekedSkipped int
+	savedOffset   string
+}
+
+func newDiskSpool(dir string, maxSize int64, maxAge time.Duration) (*diskSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	this := &diskSpool{dir: dir, maxSize: maxSize, maxAge: maxAge}
+	this.cond = sync.NewCond(&this.Mutex)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(file), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segment := &spoolSegment{id: id}
+		if err := segment.scan(file); err != nil {
+			return nil, err
+		}
+
+		this.segments = append(this.segments, segment)
+	}
+
+	this.restorePosition()
+
+	// never append to a segment that might end with a partial write
+	if err := this.rotate(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+func (this *spoolSegment) scan(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	this.size = info.Size()
+	this.modified = info.ModTime()
+
+	r := bufio.NewReader(f)
+	for {
+		if _, err := r.ReadBytes('\n'); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		this.records++
+	}
+}
+
+func (this *diskSpool) restorePosition() {
+	data, err := ioutil.ReadFile(filepath.Join(this.dir, SPOOL_POSITION))
+	if err != nil {
+		return
+	}
+
+	var id uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &id, &offset); err != nil {
+		return
+	}
+
+	// segments before the saved position were completely sent already
+	for len(this.segments) > 0 && this.segments[0].id < id {
+		os.Remove(filepath.Join(this.dir, this.segments[0].name()))
+		this.segments = this.segments[1:]
+	}
+
+	if len(this.segments) == 0 || this.segments[0].id != id || offset > this.segments[0].size {
+		return
+	}
+
+	f, err := os.Open(filepath.Join(this.dir, this.segments[0].name()))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(io.LimitReader(f, offset))
+	for {
+		if _, err := r.ReadBytes('\n'); err != nil {
+			break
+		}
+
+		this.readRecords++
+	}
+
+	this.readOffset = offset
+	this.savedOffset = string(data)
+}
+
+// Must be called with the lock held
+func (this *diskSpool) rotate() error {
+	if this.head != nil {
+		this.head.Sync()
+		this.head.Close()
+	}
+
+	segment := &spoolSegment{id: 1, modified: time.Now()}
+	if len(this.segments) > 0 {
+		segment.id = this.segments[len(this.segments)-1].id + 1
+	}
+
+	f, err := os.OpenFile(filepath.Join(this.dir, segment.name()), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	this.head = f
+	this.segments = append(this.segments, segment)
+
+	return nil
+}
+
+func (this *diskSpool) Append(cursor string, realtime int64, message *gelf.Message) error {
+	line, err := json.Marshal(spoolRecord{Cursor: cursor, Realtime: realtime, Message: message, Extra: message.Extra})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	this.Lock()
+	defer this.Unlock()
+
+	if _, err := this.head.Write(line); err != nil {
+		return err
+	}
+
+	segment := this.segments[len(this.segments)-1]
+	segment.size += int64(len(line))
+	segment.records++
+	segment.modified = time.Now()
+
+	if segment.size >= SPOOL_SEGMENT_SIZE {
+		if err := this.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if this.maxSize > 0 {
+		for this.size() > this.maxSize && len(this.segments) > 1 {
+			this.dropOldest("spool exceeds its maximum size")
+		}
+	}
+
+	this.cond.Broadcast()
+
+	return nil
+}
+
+// Must be called with the lock held
+func (this *diskSpool) size() (size int64) {
+	for _, segment := range this.segments {
+		size += segment.size
+	}
+
+	return
+}
+
+// Number of records that still need to be sent
+func (this *diskSpool) Depth() (depth int) {
+	if this == nil {
+		return 0
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	return this.depth()
+}
+
+func (this *diskSpool) depth() (depth int) {
+	for _, segment := range this.segments {
+		depth += segment.records
+	}
+
+	return depth - this.readRecords
+}
+
+// Must be called with the lock held, and with at least two segments
+func (this *diskSpool) dropOldest(reason string) {
+	segment := this.segments[0]
+	lost := segment.records - this.readRecords
+
+	this.closeReader()
+	os.Remove(filepath.Join(this.dir, segment.name()))
+	this.segments = this.segments[1:]
+
+	if lost > 0 {
+		fmt.Fprintf(os.Stderr, "spool - dropped %d entries because %s\n", lost, reason)
+	}
+}
+
+// Must be called with the lock held
+func (this *diskSpool) closeReader() {
+	if this.readFile != nil {
+		this.readFile.Close()
+	}
+
+	this.readFile = nil
+	this.reader = nil
+	this.readOffset = 0
+	this.readRecords = 0
+	this.peeked = nil
+	this.peekedLen = 0
+	this.peekedSkipped = 0
+}
+
+// Blocks until a record is available. Returns the same record until it is acknowledged with Ack
+func (this *diskSpool) Next() *spoolRecord {
+	return this.NextBatch(1)[0]
+}
+
+// Blocks until a record is available, and returns it with the records after it that can be read
+// without waiting, up to max. Returns the same records until they are acknowledged with Ack
+func (this *diskSpool) NextBatch(max int) []*spoolRecord {
+	this.Lock()
+	defer this.Unlock()
+
+	for len(this.peeked) == 0 {
+		this.read(true)
+	}
+
+	for len(this.peeked) < max && this.read(false) {
+	}
+
+	return this.peeked
+}
+
+// Reads the record after those peeked, reports whether it did. Only waits for a new record with
+// wait, batches don't continue into the next segment. Must be called with the lock held
+func (this *diskSpool) read(wait bool) bool {
+	segment := this.segments[0]
+	isHead := len(this.segments) == 1
+
+	if this.reader == nil {
+		f, err := os.Open(filepath.Join(this.dir, segment.name()))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "spool - could not read segment: "+err.Error())
+			this.dropOldest("its segment is unreadable")
+			return false
+		}
+		if _, err := f.Seek(this.readOffset, io.SeekStart); err != nil {
+			f.Close()
+			fmt.Fprintln(os.Stderr, "spool - could not read segment: "+err.Error())
+			this.dropOldest("its segment is unreadable")
+			return false
+		}
+
+		this.readFile = f
+		this.reader = bufio.NewReader(f)
+	}
+
+	line, err := this.reader.ReadBytes('\n')
+	if err == nil {
+		var record spoolRecord
+		if err := json.Unmarshal(line, &record); err != nil || record.Message == nil {
+			fmt.Fprintln(os.Stderr, "spool - skipping unreadable entry")
+			if len(this.peeked) == 0 {
+				this.readOffset += int64(len(line))
+				this.readRecords++
+			} else {
+				this.peekedLen += int64(len(line))
+				this.peekedSkipped++
+			}
+			return false
+		}
+
+		for k, v := range record.Extra {
+			if record.Message.Extra == nil {
+				record.Message.Extra = make(map[string]interface{}, len(record.Extra))
+			}
+			record.Message.Extra[k] = v
+		}
+
+		this.peeked = append(this.peeked, &record)
+		this.peekedLen += int64(len(line))
+
+		return true
+	} else if isHead {
+		// caught up with the writer, rewind any partial line and wait for more
+		this.readFile.Seek(this.readOffset+this.peekedLen, io.SeekStart)
+		this.reader.Reset(this.readFile)
+		if wait {
+			this.cond.Wait()
+		}
+	} else if len(this.peeked) == 0 {
+		this.closeReader()
+		os.Remove(filepath.Join(this.dir, segment.name()))
+		this.segments = this.segments[1:]
+	}
+
+	return false
+}
+
+// Marks the records returned by Next or NextBatch as sent
+func (this *diskSpool) Ack() {
+	this.Lock()
+	defer this.Unlock()
+
+	if len(this.peeked) == 0 {
+		return
+	}
+
+	this.readOffset += this.peekedLen
+	this.readRecords += len(this.peeked) + this.peekedSkipped
+	this.peeked = nil
+	this.peekedLen = 0
+	this.peekedSkipped = 0
+
+	if this.depth() == 0 {
+		this.cond.Broadcast()
+	}
+}
+
+// Blocks until every record has been sent, or returns false once expired is closed
+func (this *diskSpool) WaitEmpty(expired <-chan struct{}) bool {
+	if this == nil {
+		return true
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go broadcastOnExpiry(this.cond, expired, stop)
+
+	for this.depth() > 0 {
+		select {
+		case <-expired:
+			return false
+		default:
+		}
+
+		this.cond.Wait()
+	}
+
+	return true
+}
+
+// Syncs appended records to disk, saves the read position and expires old segments
+func (this *diskSpool) Flush() error {
+	if this == nil {
+		return nil
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	if this.maxAge > 0 {
+		for len(this.segments) > 1 && time.Since(this.segments[0].modified) > this.maxAge {
+			this.dropOldest("they exceeded the maximum age")
+		}
+	}
+
+	if err := this.head.Sync(); err != nil {
+		return err
+	}
+
+	position := fmt.Sprintf("%d %d\n", this.segments[0].id, this.readOffset)
+	if position == this.savedOffset {
+		return nil
+	}
+
+	if err := writeFileAtomic(filepath.Join(this.dir, SPOOL_POSITION), []byte(position)); err != nil {
+		return err
+	}
+
+	this.savedOffset = position
+
+	return nil
+}
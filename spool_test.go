@@ -0,0 +1,111 @@
+package main
+
+import (
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpoolResumesAfterAcknowledgedRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	AssertNotError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := newDiskSpool(dir, 0, 0)
+	AssertNotError(t, err)
+
+	AssertNotError(t, s.Append("c1", 1549067421724300, &gelf.Message{Short: "first", Extra: map[string]interface{}{"Pid": "1"}}))
+	AssertNotError(t, s.Append("c2", 0, &gelf.Message{Short: "second"}))
+	AssertEquals(t, 2, s.Depth())
+
+	record := s.Next()
+	AssertEquals(t, "c1", record.Cursor)
+	AssertEquals(t, int64(1549067421724300), record.Realtime)
+	AssertEquals(t, "first", record.Message.Short)
+	AssertEquals(t, "1", record.Message.Extra["Pid"])
+
+	// unacknowledged records are returned again
+	AssertEquals(t, record, s.Next())
+	s.Ack()
+	AssertEquals(t, 1, s.Depth())
+	AssertNotError(t, s.Flush())
+
+	s, err = newDiskSpool(dir, 0, 0)
+	AssertNotError(t, err)
+	AssertEquals(t, 1, s.Depth())
+	AssertEquals(t, "second", s.Next().Message.Short)
+	s.Ack()
+	AssertEquals(t, 0, s.Depth())
+}
+
+func TestSpoolDropsOldestSegmentsWhenFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	AssertNotError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := newDiskSpool(dir, 1, 0)
+	AssertNotError(t, err)
+
+	AssertNotError(t, s.Append("c1", 0, &gelf.Message{Short: "old"}))
+	s.Lock()
+	AssertNotError(t, s.rotate())
+	s.Unlock()
+	AssertNotError(t, s.Append("c2", 0, &gelf.Message{Short: "new"}))
+
+	AssertEquals(t, 1, s.Depth())
+	AssertEquals(t, "new", s.Next().Message.Short)
+}
+
+func TestSpoolBatchesStopAtSegmentsAndUnreadableLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	AssertNotError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := newDiskSpool(dir, 0, 0)
+	AssertNotError(t, err)
+
+	for _, short := range []string{"1", "2", "3"} {
+		AssertNotError(t, s.Append("c"+short, 0, &gelf.Message{Short: short}))
+	}
+	s.Lock()
+	AssertNotError(t, s.rotate())
+	s.Unlock()
+	AssertNotError(t, s.Append("c4", 0, &gelf.Message{Short: "4"}))
+	s.Lock()
+	s.head.WriteString("not json\n")
+	s.segments[len(s.segments)-1].size += int64(len("not json\n"))
+	s.segments[len(s.segments)-1].records++
+	s.Unlock()
+	AssertNotError(t, s.Append("c5", 0, &gelf.Message{Short: "5"}))
+
+	batch := s.NextBatch(2)
+	AssertEquals(t, 2, len(batch))
+	AssertEquals(t, "c2", batch[1].Cursor)
+	s.Ack()
+
+	// the rest of the first segment, not continuing into the second one
+	batch = s.NextBatch(10)
+	AssertEquals(t, 1, len(batch))
+	AssertEquals(t, "3", batch[0].Message.Short)
+	s.Ack()
+	AssertEquals(t, 3, s.Depth())
+
+	// the unreadable line ends the batch, and is acknowledged with it
+	batch = s.NextBatch(10)
+	AssertEquals(t, 1, len(batch))
+	AssertEquals(t, "4", batch[0].Message.Short)
+	s.Ack()
+	AssertEquals(t, 1, s.Depth())
+
+	batch = s.NextBatch(10)
+	AssertEquals(t, 1, len(batch))
+	AssertEquals(t, "5", batch[0].Message.Short)
+	s.Ack()
+	AssertEquals(t, 0, s.Depth())
+	AssertNotError(t, s.Flush())
+
+	s, err = newDiskSpool(dir, 0, 0)
+	AssertNotError(t, err)
+	AssertEquals(t, 0, s.Depth())
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Strips a timestamp at the start of messages of the selected units or identifiers, trying Formats
+// in order, only the legacy format by default. The stripped timestamp is kept in Field when set,
+// and with UseAsTime it replaces the time of the journal entry. Timestamps without a zone are in
+// Timezone, the local time by default
+type timestampConfig struct {
+	unitSelector
+	Formats   []string `json:"formats"`
+	Field     string   `json:"field"`
+	UseAsTime bool     `json:"use_as_time"`
+	Timezone  string   `json:"timezone"`
+
+	formats  []*timestampFormat
+	field    string
+	location *time.Location
+}
+
+// The first group of regex is the timestamp, which is parsed with one of layouts, or as seconds or
+// milliseconds since the epoch with epoch
+type timestampFormat struct {
+	regex   *regexp.Regexp
+	layouts []string
+	epoch   bool
+}
+
+var isoLayouts = []string{
+	"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05Z07", "2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05Z0700", "2006-01-02 15:04:05Z07", "2006-01-02 15:04:05",
+}
+
+var syslogLayouts = []string{"Jan _2 15:04:05"}
+
+var apacheLayouts = []string{"Mon Jan _2 15:04:05 2006", "02/Jan/2006:15:04:05 -0700"}
+
+var nginxLayouts = []string{"2006/01/02 15:04:05"}
+
+var timestampFormats = map[string]*timestampFormat{
+	"legacy": {
+		regex:   regexp.MustCompile(`^(20[0-9][0-9][/\-][01][0-9][/\-][0123][0-9] [0-2]?[0-9]:[0-5][0-9]:[0-5][0-9][,0-9]{0,3}) `),
+		layouts: []string{"2006-01-02 15:04:05", "2006/01/02 15:04:05"},
+	},
+	"iso8601": {
+		regex:   regexp.MustCompile(`^([0-9]{4}-[0-9]{2}-[0-9]{2}[T ][0-9]{2}:[0-9]{2}:[0-9]{2}(?:[.,][0-9]+)?(?:Z|[+-][0-9]{2}(?::?[0-9]{2})?)?)\s+`),
+		layouts: isoLayouts,
+	},
+	"syslog": {
+		regex:   regexp.MustCompile(`^([A-Z][a-z]{2} [ 0-9][0-9] [0-9]{2}:[0-9]{2}:[0-9]{2}(?:\.[0-9]+)?)\s+`),
+		layouts: syslogLayouts,
+	},
+	"bracket": {
+		regex:   regexp.MustCompile(`^\[([^\]]{1,64})\]\s*`),
+		layouts: concatLayouts(isoLayouts, syslogLayouts, apacheLayouts, nginxLayouts),
+		epoch:   true,
+	},
+	"nginx": {
+		regex:   regexp.MustCompile(`^([0-9]{4}/[0-9]{2}/[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2})\s+`),
+		layouts: nginxLayouts,
+	},
+	"apache": {
+		regex:   regexp.MustCompile(`^\[([A-Z][a-z]{2} [A-Z][a-z]{2} [ 0-9][0-9] [0-9]{2}:[0-9]{2}:[0-9]{2}(?:\.[0-9]+)? [0-9]{4}|[0-9]{2}/[A-Z][a-z]{2}/[0-9]{4}:[0-9]{2}:[0-9]{2}:[0-9]{2} [+-][0-9]{4})\]\s*`),
+		layouts: apacheLayouts,
+	},
+	"epoch": {
+		regex: regexp.MustCompile(`^([0-9]{10}(?:\.[0-9]+)?|[0-9]{13})\s+`),
+		epoch: true,
+	},
+}
+
+func concatLayouts(lists ...[]string) []string {
+	var layouts []string
+	for _, list := range lists {
+		layouts = append(layouts, list...)
+	}
+
+	return layouts
+}
+
+// Without a config file, the legacy format is stripped from every message
+var defaultTimestamps = []timestampConfig{{Formats: []string{"legacy"}}}
+
+func (this *timestampConfig) compile(key string) error {
+	if err := this.unitSelector.validate(key); err != nil {
+		return err
+	}
+
+	if len(this.Formats) == 0 {
+		this.Formats = []string{"legacy"}
+	}
+
+	this.formats = nil
+	for i, name := range this.Formats {
+		format, ok := timestampFormats[name]
+		if !ok {
+			return fmt.Errorf("%s.formats[%d]: unknown format %q, use iso8601, syslog, bracket, nginx, apache, epoch or legacy", key, i, name)
+		}
+
+		this.formats = append(this.formats, format)
+	}
+
+	this.field = ""
+	if this.Field != "" {
+		name, ok := gelfFieldName(this.Field)
+		if !ok {
+			return fmt.Errorf("%s.field: %q cannot be used as a field name", key, this.Field)
+		}
+		this.field = name
+	}
+
+	this.location = time.Local
+	if this.Timezone != "" {
+		location, err := time.LoadLocation(this.Timezone)
+		if err != nil {
+			return fmt.Errorf("%s.timezone: %s", key, err)
+		}
+		this.location = location
+	}
+
+	return nil
+}
+
+// Times without a year are placed in the year of reference, or the one before when that would be in the future
+func (this *timestampFormat) parse(text string, location *time.Location, reference time.Time) (time.Time, bool) {
+	text = strings.Replace(text, ",", ".", 1)
+
+	for _, layout := range this.layouts {
+		t, err := time.ParseInLocation(layout, text, location)
+		if err != nil {
+			continue
+		}
+
+		if t.Year() == 0 {
+			t = t.AddDate(reference.Year(), 0, 0)
+			if t.Sub(reference) > 24*time.Hour {
+				t = t.AddDate(-1, 0, 0)
+			}
+		}
+
+		return t, true
+	}
+
+	if this.epoch {
+		seconds, err := strconv.ParseFloat(text, 64)
+		if err == nil && (len(text) == 10 || len(text) == 13 || strings.IndexByte(text, '.') == 10) {
+			if len(text) == 13 {
+				seconds /= 1000
+			}
+
+			return time.Unix(0, int64(seconds*float64(time.Second))), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// Strips the legacy format for entries that no configured timestamps entry selects
+var fallbackTimestamps = timestampConfig{formats: []*timestampFormat{timestampFormats["legacy"]}, location: time.Local}
+
+// Returns the first timestamp config for this entry's unit or identifier. Without either, a config
+// applies to every entry. When none do the legacy format is still stripped, unless timestamps is empty
+func timestampsFor(entry *SystemdJournalEntry) *timestampConfig {
+	if len(config.Timestamps) == 0 {
+		return nil
+	}
+
+	for i := range config.Timestamps {
+		timestamps := &config.Timestamps[i]
+
+		if timestamps.matches(entry) {
+			return timestamps
+		}
+	}
+
+	return &fallbackTimestamps
+}
+
+// Removes a timestamp the application logged at the start of the message, when it can be parsed
+func stripTimestamp(entry *SystemdJournalEntry) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	timestamps := timestampsFor(entry)
+	if timestamps == nil {
+		return
+	}
+
+	reference := time.Unix(0, entry.Realtime_timestamp*1000)
+	if entry.Realtime_timestamp == 0 {
+		reference = time.Now()
+	}
+
+	for _, format := range timestamps.formats {
+		match := format.regex.FindStringSubmatchIndex(entry.Message)
+		if match == nil {
+			continue
+		}
+
+		t, ok := format.parse(entry.Message[match[2]:match[3]], timestamps.location, reference)
+		if !ok {
+			continue
+		}
+
+		entry.Message = entry.Message[match[1]:]
+
+		if timestamps.field != "" {
+			if entry.Extra == nil {
+				entry.Extra = make(map[string]interface{})
+			}
+			entry.Extra[timestamps.field] = float64(t.UnixNano()) / float64(time.Second)
+		}
+
+		if timestamps.UseAsTime {
+			entry.Event_timestamp = t.UnixNano() / 1000
+		}
+
+		return
+	}
+}
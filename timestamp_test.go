@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+)
+
+// When the entries were written to the journal, 2021-03-01 12:00:00 UTC
+const journalTime = "1614600000000000"
+
+func TestTimestampFormats(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	for _, test := range []struct {
+		format, message, expected string
+		seconds                   float64
+	}{
+		{"legacy", "2021-02-28 23:59:58,25 started", "started", 1614556798.25},
+		{"iso8601", "2021-02-28T23:59:58.5+01:00 started", "started", 1614553198.5},
+		{"iso8601", "2021-02-28T23:59:58Z\tstarted", "started", 1614556798},
+		{"iso8601", "2021-02-28 23:59:58 started", "started", 1614556798},
+		{"syslog", "Feb 28 23:59:58 started", "started", 1614556798},
+		{"syslog", "Dec 31 23:59:58 started", "started", 1609459198},
+		{"bracket", "[2021-02-28T23:59:58Z] started", "started", 1614556798},
+		{"bracket", "[1614556798.250] started", "started", 1614556798.25},
+		{"bracket", "[Warning] started", "[Warning] started", 0},
+		{"nginx", "2021/02/28 23:59:58 [error] 12#12: started", "[error] 12#12: started", 1614556798},
+		{"apache", "[Sun Feb 28 23:59:58.000123 2021] [core:error] started", "[core:error] started", 1614556798.000123},
+		{"apache", "[28/Feb/2021:23:59:58 +0100] started", "started", 1614553198},
+		{"epoch", "1614556798 started", "started", 1614556798},
+		{"epoch", "1614556798250 started", "started", 1614556798.25},
+		{"epoch", "12345 started", "12345 started", 0},
+	} {
+		config.Timestamps = []timestampConfig{{Formats: []string{test.format}, Field: "logged_at", Timezone: "UTC"}}
+		AssertNotError(t, config.Timestamps[0].compile("timestamps[0]"))
+
+		entry := testEntry(t, map[string]string{"_SYSTEMD_UNIT": "app.service", "MESSAGE": test.message, "__REALTIME_TIMESTAMP": journalTime})
+		stripTimestamp(entry)
+
+		AssertEquals(t, test.expected, entry.Message)
+		if test.seconds == 0 {
+			AssertEquals(t, nil, entry.Extra["_logged_at"])
+		} else if seconds, _ := entry.Extra["_logged_at"].(float64); seconds < test.seconds-0.0001 || seconds > test.seconds+0.0001 {
+			t.Errorf("%s %q: expected %f, got %f", test.format, test.message, test.seconds, seconds)
+		}
+	}
+}
+
+func TestTimestampsSelectedByUnit(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	config.Timestamps = []timestampConfig{
+		{unitSelector: unitSelector{Units: []string{"nginx.service"}}, Formats: []string{"nginx"}, UseAsTime: true, Timezone: "UTC"},
+		{Formats: []string{"iso8601", "legacy"}},
+	}
+	for i := range config.Timestamps {
+		AssertNotError(t, config.Timestamps[i].compile("timestamps"))
+	}
+
+	entry := testEntry(t, map[string]string{"_SYSTEMD_UNIT": "nginx.service", "MESSAGE": "2021/02/28 23:59:58 [error] failed", "__REALTIME_TIMESTAMP": journalTime})
+	stripTimestamp(entry)
+	AssertEquals(t, "[error] failed", entry.Message)
+	AssertEquals(t, float64(1614556798), entry.toGelf().TimeUnix)
+
+	entry = testEntry(t, map[string]string{"_SYSTEMD_UNIT": "nginx.service", "MESSAGE": "2021-02-28T23:59:58Z failed", "__REALTIME_TIMESTAMP": journalTime})
+	stripTimestamp(entry)
+	AssertEquals(t, "2021-02-28T23:59:58Z failed", entry.Message)
+
+	entry = testEntry(t, map[string]string{"_SYSTEMD_UNIT": "app.service", "MESSAGE": "2021-02-28T23:59:58Z failed", "__REALTIME_TIMESTAMP": journalTime})
+	stripTimestamp(entry)
+	AssertEquals(t, "failed", entry.Message)
+	AssertEquals(t, float64(1614600000), entry.toGelf().TimeUnix)
+	AssertEquals(t, 0, len(entry.Extra))
+}
+
+func TestLegacyTimestampsStrippedForOtherUnits(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+
+	config.Timestamps = []timestampConfig{{unitSelector: unitSelector{Units: []string{"nginx.service"}}, Formats: []string{"nginx"}}}
+	AssertNotError(t, config.Timestamps[0].compile("timestamps[0]"))
+
+	entry := testEntry(t, map[string]string{"_SYSTEMD_UNIT": "app.service", "MESSAGE": "2021-02-28 23:59:58,12 failed", "__REALTIME_TIMESTAMP": journalTime})
+	stripTimestamp(entry)
+	AssertEquals(t, "failed", entry.Message)
+
+	entry = testEntry(t, map[string]string{"_SYSTEMD_UNIT": "app.service", "MESSAGE": "2021-02-28T23:59:58Z failed", "__REALTIME_TIMESTAMP": journalTime})
+	stripTimestamp(entry)
+	AssertEquals(t, "2021-02-28T23:59:58Z failed", entry.Message)
+
+	// unless stripping is turned off altogether
+	config.Timestamps = []timestampConfig{}
+
+	entry = testEntry(t, map[string]string{"_SYSTEMD_UNIT": "app.service", "MESSAGE": "2021-02-28 23:59:58,12 failed", "__REALTIME_TIMESTAMP": journalTime})
+	stripTimestamp(entry)
+	AssertEquals(t, "2021-02-28 23:59:58,12 failed", entry.Message)
+}
+
+func TestTimestampConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		timestamps timestampConfig
+		expected   string
+	}{
+		{timestampConfig{Formats: []string{"rfc822"}}, `timestamps[0].formats[0]: unknown format "rfc822", use iso8601, syslog, bracket, nginx, apache, epoch or legacy`},
+		{timestampConfig{Field: "id"}, `timestamps[0].field: "id" cannot be used as a field name`},
+	} {
+		err := test.timestamps.compile("timestamps[0]")
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("expected error %q, got %v", test.expected, err)
+		}
+	}
+}
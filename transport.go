@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type tlsOptions struct {
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"server_name"`
+}
+
+// Returns a writer for udp://, tcp://, tls://, http:// and https:// addresses. Addresses without scheme use udp
+func newWriter(address string, options tlsOptions, httpOptions httpOptions) (gelf.Writer, error) {
+	scheme, hostport := "udp", address
+	if i := strings.Index(address, "://"); i >= 0 {
+		scheme, hostport = address[:i], address[i+3:]
+	}
+
+	switch scheme {
+	case "udp":
+		return newUDPWriter(hostport)
+	case "tcp":
+		return newStreamWriter("tcp", func() (net.Conn, error) {
+			return net.DialTimeout("tcp", hostport, DIAL_TIMEOUT)
+		})
+	case "tls":
+		tlsConfig, err := options.tlsConfig(hostport)
+		if err != nil {
+			return nil, err
+		}
+
+		return newStreamWriter("tls", func() (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: DIAL_TIMEOUT}, "tcp", hostport, tlsConfig)
+		})
+	case "http", "https":
+		return newHTTPWriter(address, options, httpOptions)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, use udp://, tcp://, tls://, http:// or https://", scheme)
+	}
+}
+
+func (this tlsOptions) tlsConfig(hostport string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: this.ServerName}
+
+	if tlsConfig.ServerName == "" {
+		if host, _, err := net.SplitHostPort(hostport); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	if this.CA != "" {
+		pem, err := ioutil.ReadFile(this.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + this.CA)
+		}
+	}
+
+	if this.Cert != "" || this.Key != "" {
+		cert, err := tls.LoadX509KeyPair(this.Cert, this.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Sends null-byte delimited messages over a tcp or tls connection. The vendored
+// TCPWriter cannot be used for tls, since it dials the connection itself
+type streamWriter struct {
+	sync.Mutex
+	dial      func() (net.Conn, error)
+	conn      net.Conn
+	timeout   time.Duration
+	hostname  string
+	bytesSent *counter
+}
+
+func newStreamWriter(transport string, dial func() (net.Conn, error)) (*streamWriter, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &streamWriter{dial: dial, conn: conn, timeout: WRITE_TIMEOUT, hostname: hostname, bytesSent: metrics.bytesSent.With(transport)}, nil
+}
+
+func (this *streamWriter) WriteMessage(m *gelf.Message) error {
+	var buf bytes.Buffer
+	if err := m.MarshalJSONBuf(&buf); err != nil {
+		return err
+	}
+	buf.WriteByte(0)
+
+	return this.write(buf.Bytes())
+}
+
+// Writes the null delimited messages at once. A connection that fails in the middle may have
+// delivered some of them, but since that can't be known they all count as unsent
+func (this *streamWriter) WriteMessages(messages []*gelf.Message) (int, error) {
+	var buf bytes.Buffer
+	for _, m := range messages {
+		if err := m.MarshalJSONBuf(&buf); err != nil {
+			return 0, err
+		}
+		buf.WriteByte(0)
+	}
+
+	if err := this.write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(messages), nil
+}
+
+// Reconnects once when the write fails, send() takes care of retrying after that
+func (this *streamWriter) write(data []byte) error {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.conn != nil {
+		if err := this.writeConn(data); err == nil {
+			this.bytesSent.Add(uint64(len(data)))
+			return nil
+		}
+
+		this.conn.Close()
+		this.conn = nil
+	}
+
+	conn, err := this.dial()
+	if err != nil {
+		return err
+	}
+	this.conn = conn
+
+	if err := this.writeConn(data); err != nil {
+		this.conn.Close()
+		this.conn = nil
+
+		return err
+	}
+
+	this.bytesSent.Add(uint64(len(data)))
+
+	return nil
+}
+
+// A peer that stops reading would otherwise block the sender forever
+func (this *streamWriter) writeConn(data []byte) error {
+	if err := this.conn.SetWriteDeadline(time.Now().Add(this.timeout)); err != nil {
+		return err
+	}
+
+	_, err := this.conn.Write(data)
+
+	return err
+}
+
+func (this *streamWriter) Write(p []byte) (int, error) {
+	if err := this.WriteMessage(newTextMessage(this.hostname, p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// For the Write method of gelf.Writer, which isn't used by this program itself
+func newTextMessage(hostname string, p []byte) *gelf.Message {
+	return &gelf.Message{
+		Version:  "1.1",
+		Host:     hostname,
+		Short:    string(bytes.TrimSpace(p)),
+		TimeUnix: float64(time.Now().UnixNano()) / float64(time.Second),
+		Level:    gelf.LOG_INFO,
+	}
+}
+
+func (this *streamWriter) Close() error {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.conn == nil {
+		return nil
+	}
+
+	err := this.conn.Close()
+	this.conn = nil
+
+	return err
+}
+
+// The vendored UDPWriter, which doesn't tell what it sent. Bytes are counted before compression,
+// and only messages that don't fit in a datagram uncompressed are compressed again to count chunks
+type udpWriter struct {
+	*gelf.UDPWriter
+	hostname  string
+	bytesSent *counter
+}
+
+func newUDPWriter(hostport string) (*udpWriter, error) {
+	w, err := gelf.NewUDPWriter(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &udpWriter{UDPWriter: w, hostname: hostname, bytesSent: metrics.bytesSent.With("udp")}, nil
+}
+
+func (this *udpWriter) WriteMessage(m *gelf.Message) error {
+	var buf bytes.Buffer
+	if err := m.MarshalJSONBuf(&buf); err != nil {
+		return err
+	}
+
+	if err := this.UDPWriter.WriteMessage(m); err != nil {
+		return err
+	}
+
+	this.bytesSent.Add(uint64(buf.Len()))
+	if buf.Len() > gelf.ChunkSize {
+		metrics.udpChunks.Add(uint64(udpChunks(buf.Bytes())))
+	}
+
+	return nil
+}
+
+// The number of datagrams the vendored writer sends a chunked message in, 0 when it fits in one
+func udpChunks(message []byte) int {
+	var compressed bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&compressed, flate.BestSpeed)
+	zw.Write(message)
+	zw.Close()
+
+	if compressed.Len() <= gelf.ChunkSize {
+		return 0
+	}
+
+	// every chunk starts with a 12 byte header
+	return compressed.Len()/(gelf.ChunkSize-12) + 1
+}
+
+func (this *udpWriter) Write(p []byte) (int, error) {
+	if err := this.WriteMessage(newTextMessage(this.hostname, p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"gopkg.in/Graylog2/go-gelf.v2/gelf"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnsupportedScheme(t *testing.T) {
+	_, err := newWriter("smtp://localhost:25", tlsOptions{}, defaultHTTPOptions)
+
+	AssertError(t, err)
+}
+
+func TestTcpWriterSendsNullTerminatedMessages(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertNotError(t, err)
+	defer listener.Close()
+
+	received := readStreamMessage(t, listener)
+
+	w, err := newWriter("tcp://"+listener.Addr().String(), tlsOptions{}, defaultHTTPOptions)
+	AssertNotError(t, err)
+	defer w.Close()
+
+	AssertNotError(t, w.WriteMessage(&gelf.Message{Version: "1.1", Host: "machine.nl", Short: "hello"}))
+
+	m := <-received
+	AssertEquals(t, "machine.nl", m.Host)
+	AssertEquals(t, "hello", m.Short)
+}
+
+func TestUdpWriterChunksLargeMessages(t *testing.T) {
+	r, err := gelf.NewReader("127.0.0.1:0")
+	AssertNotError(t, err)
+
+	w, err := newWriter("udp://"+r.Addr(), tlsOptions{}, defaultHTTPOptions)
+	AssertNotError(t, err)
+	defer w.Close()
+
+	// random bytes don't compress, so this can't fit in a single datagram
+	data := make([]byte, 3*gelf.ChunkSize)
+	rand.Read(data)
+	full := fmt.Sprintf("%x", data)
+
+	chunks := metrics.udpChunks.Get()
+	sent := metrics.bytesSent.With("udp").Get()
+
+	AssertNotError(t, w.WriteMessage(&gelf.Message{Version: "1.1", Host: "machine.nl", Short: "hello", Full: full}))
+
+	m, err := r.ReadMessage()
+	AssertNotError(t, err)
+	AssertEquals(t, "hello", m.Short)
+	AssertEquals(t, full, m.Full)
+
+	if metrics.udpChunks.Get()-chunks < 4 {
+		t.Errorf("expected at least 4 chunks, got %d", metrics.udpChunks.Get()-chunks)
+	}
+	if metrics.bytesSent.With("udp").Get()-sent < uint64(len(data)) {
+		t.Errorf("expected at least %d bytes sent, got %d", len(data), metrics.bytesSent.With("udp").Get()-sent)
+	}
+}
+
+func TestTlsWriterVerifiesAgainstCa(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	AssertNotError(t, err)
+	defer os.RemoveAll(dir)
+
+	cert, certFile := generateCertificate(t, dir)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	AssertNotError(t, err)
+	defer listener.Close()
+
+	received := readStreamMessage(t, listener)
+
+	w, err := newWriter("tls://"+listener.Addr().String(), tlsOptions{CA: certFile, ServerName: "localhost"}, defaultHTTPOptions)
+	AssertNotError(t, err)
+	defer w.Close()
+
+	AssertNotError(t, w.WriteMessage(&gelf.Message{Version: "1.1", Host: "machine.nl", Short: "secret"}))
+
+	m := <-received
+	AssertEquals(t, "secret", m.Short)
+}
+
+func TestTlsWriterPresentsClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	AssertNotError(t, err)
+	defer os.RemoveAll(dir)
+
+	cert, certFile := generateCertificate(t, dir)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	AssertNotError(t, err)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(leaf)
+
+	presented := make(chan int, 1)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			presented <- len(rawCerts)
+			return nil
+		},
+	})
+	AssertNotError(t, err)
+	defer listener.Close()
+
+	received := readStreamMessage(t, listener)
+
+	options := tlsOptions{CA: certFile, Cert: certFile, Key: filepath.Join(dir, "key.pem"), ServerName: "localhost"}
+	w, err := newWriter("tls://"+listener.Addr().String(), options, defaultHTTPOptions)
+	AssertNotError(t, err)
+	defer w.Close()
+
+	AssertNotError(t, w.WriteMessage(&gelf.Message{Version: "1.1", Host: "machine.nl", Short: "mutual"}))
+
+	m := <-received
+	AssertEquals(t, "mutual", m.Short)
+	AssertEquals(t, 1, <-presented)
+}
+
+func TestStreamWriterGivesUpOnStalledPeer(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	unreachable := func() (net.Conn, error) { return nil, errors.New("unreachable") }
+	w := &streamWriter{dial: unreachable, conn: client, timeout: 10 * time.Millisecond, bytesSent: metrics.bytesSent.With("tcp")}
+
+	// nothing reads from the pipe, so without the deadline this would block forever
+	AssertError(t, w.write([]byte("stalled")))
+}
+
+// Accepts a single connection in the background and returns the first message read from it
+func readStreamMessage(t *testing.T, listener net.Listener) <-chan gelf.Message {
+	received := make(chan gelf.Message, 1)
+
+	go func() {
+		defer close(received)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, err := bufio.NewReader(conn).ReadBytes(0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var m gelf.Message
+		if err := m.UnmarshalJSON(data[:len(data)-1]); err != nil {
+			t.Error(err)
+		}
+
+		received <- m
+	}()
+
+	return received
+}
+
+func generateCertificate(t *testing.T, dir string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	AssertNotError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	AssertNotError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	AssertNotError(t, err)
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	certFile := filepath.Join(dir, "cert.pem")
+	AssertNotError(t, ioutil.WriteFile(certFile, certPem, 0600))
+	AssertNotError(t, ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPem, 0600))
+
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	AssertNotError(t, err)
+
+	return cert, certFile
+}